@@ -1,35 +1,79 @@
 package apmconnector
 
 import (
+	"path"
+
 	"go.opentelemetry.io/collector/pdata/pcommon"
 )
 
+// DefaultResourceAttributes are the resource attributes kept on the APM metrics
+var DefaultResourceAttributes = []string{"os.description", "telemetry.auto.version", "telemetry.sdk.language", "host.name",
+	"os.type", "telemetry.sdk.name", "process.runtime.description", "process.runtime.version", "telemetry.sdk.version",
+	"host.arch", "service.name", "service.instance.id"}
+
+// DefaultDerivedResourceAttributes maps an attribute to the resource attribute it is copied from when it is missing
+var DefaultDerivedResourceAttributes = map[string]string{
+	"host":                "host.name",
+	"service.instance.id": "host.name",
+}
+
 type AttributeFilter struct {
+	// names or glob patterns
 	attributesToKeep []string
+	attributesToDrop []string
+	renames          map[string]string
+	derived          map[string]string
 }
 
 func NewAttributeFilter() *AttributeFilter {
-	return &AttributeFilter{attributesToKeep: []string{"os.description", "telemetry.auto.version", "telemetry.sdk.language", "host.name",
-		"os.type", "telemetry.sdk.name", "process.runtime.description", "process.runtime.version", "telemetry.sdk.version",
-		"host.arch", "service.name", "service.instance.id"}}
+	return NewAttributeFilterFromConfig(ResourceAttributesConfig{})
+}
+
+// NewAttributeFilterFromConfig creates a filter from the connector configuration, the defaults
+// are used for the include list and the derived attributes when they are not set.
+func NewAttributeFilterFromConfig(config ResourceAttributesConfig) *AttributeFilter {
+	attributeFilter := &AttributeFilter{attributesToKeep: config.Include, attributesToDrop: config.Exclude,
+		renames: config.Rename, derived: config.Derived}
+	if attributeFilter.attributesToKeep == nil {
+		attributeFilter.attributesToKeep = DefaultResourceAttributes
+	}
+	if attributeFilter.derived == nil {
+		attributeFilter.derived = DefaultDerivedResourceAttributes
+	}
+	return attributeFilter
 }
 
 func (attributeFilter *AttributeFilter) FilterAttributes(from pcommon.Map) pcommon.Map {
-	f := from.AsRaw()
-	m := make(map[string]any)
-	for _, k := range attributeFilter.attributesToKeep {
-		if v, exists := f[k]; exists {
-			m[k] = v
+	newMap := pcommon.NewMap()
+	from.Range(func(k string, v pcommon.Value) bool {
+		if !matchesAny(attributeFilter.attributesToKeep, k) || matchesAny(attributeFilter.attributesToDrop, k) {
+			return true
+		}
+		if newName, exists := attributeFilter.renames[k]; exists {
+			k = newName
+		}
+		v.CopyTo(newMap.PutEmpty(k))
+		return true
+	})
+	for name, source := range attributeFilter.derived {
+		if _, exists := newMap.Get(name); exists {
+			continue
+		}
+		if value, exists := from.Get(source); exists {
+			newMap.PutStr(name, value.AsString())
 		}
 	}
-	newMap := pcommon.NewMap()
-	newMap.FromRaw(m)
-	if hostName, exists := from.Get("host.name"); exists {
-		newMap.PutStr("host", hostName.AsString())
+	return newMap
+}
 
-		if _, e := newMap.Get("service.instance.id"); !e {
-			newMap.PutStr("service.instance.id", hostName.AsString())
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if pattern == name {
+			return true
+		}
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
 		}
 	}
-	return newMap
+	return false
 }
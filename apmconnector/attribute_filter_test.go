@@ -48,3 +48,39 @@ func TestFilterAttributesInstancePresent(t *testing.T) {
 		assert.Equal(t, "839944", instanceId.AsString())
 	}
 }
+
+func TestFilterAttributesFromConfig(t *testing.T) {
+	m := pcommon.NewMap()
+	m.PutStr("service.name", "MyApp")
+	m.PutStr("host.name", "loki")
+	m.PutStr("deployment.environment", "production")
+	m.PutStr("k8s.pod.name", "myapp-5d8f")
+	m.PutStr("k8s.pod.uid", "1234")
+	m.PutStr("k8s.namespace.name", "team")
+	m.PutStr("team.owner", "apm")
+	m.PutStr("stuff", "meh")
+	filtered := NewAttributeFilterFromConfig(ResourceAttributesConfig{
+		Include: []string{"service.name", "deployment.environment", "k8s.*", "team.owner"},
+		Exclude: []string{"k8s.*.uid"},
+		Rename:  map[string]string{"team.owner": "owner"},
+		Derived: map[string]string{"service.instance.id": "k8s.pod.name"},
+	}).FilterAttributes(m)
+
+	assert.Equal(t, map[string]any{
+		"service.name":           "MyApp",
+		"deployment.environment": "production",
+		"k8s.pod.name":           "myapp-5d8f",
+		"k8s.namespace.name":     "team",
+		"owner":                  "apm",
+		"service.instance.id":    "myapp-5d8f",
+	}, filtered.AsRaw())
+}
+
+func TestFilterAttributesNoDerived(t *testing.T) {
+	m := pcommon.NewMap()
+	m.PutStr("service.name", "MyApp")
+	m.PutStr("host.name", "loki")
+	filtered := NewAttributeFilterFromConfig(ResourceAttributesConfig{Derived: map[string]string{}}).FilterAttributes(m)
+
+	assert.Equal(t, map[string]any{"service.name": "MyApp", "host.name": "loki"}, filtered.AsRaw())
+}
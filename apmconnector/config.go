@@ -1,5 +1,234 @@
 package apmconnector
 
+import (
+	"fmt"
+	"path"
+	"sort"
+	"time"
+)
+
 type Config struct {
-	ApdexT float64 `mapstructure:"apdexT"`
+	ApdexT      float64           `mapstructure:"apdexT"`
+	TraceBuffer TraceBufferConfig `mapstructure:"traceBuffer"`
+	Metrics     MetricsConfig     `mapstructure:"metrics"`
+	// ResourceAttributes selects the resource attributes kept on the APM metrics
+	ResourceAttributes ResourceAttributesConfig `mapstructure:"resourceAttributes"`
+	// NamingRules rewrite, in order, the url path of the transactions named after url.path
+	NamingRules []NamingRuleConfig `mapstructure:"namingRules"`
+	// OtherTransactionRules promote root spans that are neither server nor consumer spans to
+	// OtherTransaction/{category}/{span name} transactions, the first matching rule wins. There is
+	// no rule by default, the span names would become transaction names.
+	OtherTransactionRules []OtherTransactionRuleConfig `mapstructure:"otherTransactions"`
+	// CardinalityLimits caps the distinct transaction and segment names of each service
+	CardinalityLimits CardinalityLimitsConfig `mapstructure:"cardinalityLimits"`
+	// SqlObfuscation controls what the trace connector does with the statements of database spans:
+	// off, obfuscate (literals replaced with ?) or drop. Unless it is off, the statements of the
+	// non SQL systems (MongoDB, Elasticsearch...) are dropped without a hash.
+	SqlObfuscation SqlObfuscationMode `mapstructure:"sqlObfuscation"`
+	// Errors decides which transactions are errors
+	Errors ErrorRulesConfig `mapstructure:"errors"`
+	// LogsOutput selects the events of the logs connector: transactions (Transaction and
+	// TransactionError events), spans (a Span event per span) or all
+	LogsOutput LogsOutputMode `mapstructure:"logsOutput"`
+	// TransactionTraces configures the sampling of the slowest transactions by the logs connector
+	TransactionTraces TransactionTracesConfig `mapstructure:"transactionTraces"`
+}
+
+// TransactionTracesConfig keeps, for each transaction name, the trace of the slowest transaction
+// over Threshold, apdexT * 4 when zero. The traces are sent every HarvestInterval, at most
+// MaxTraces of them.
+type TransactionTracesConfig struct {
+	Enabled         bool          `mapstructure:"enabled"`
+	Threshold       time.Duration `mapstructure:"threshold"`
+	HarvestInterval time.Duration `mapstructure:"harvestInterval"`
+	MaxTraces       int           `mapstructure:"maxTraces"`
+}
+
+// ErrorRulesConfig adds to the spans with an error status the ones whose http status code is in
+// ErrorStatusCodes. Status codes are codes such as "404" or ranges such as "500-599". Ignored
+// status codes and exception classes are never errors, expected errors are counted apart and do
+// not make apdex frustrating.
+type ErrorRulesConfig struct {
+	ErrorStatusCodes    []string `mapstructure:"errorStatusCodes"`
+	IgnoreStatusCodes   []string `mapstructure:"ignoreStatusCodes"`
+	IgnoreClasses       []string `mapstructure:"ignoreClasses"`
+	ExpectedStatusCodes []string `mapstructure:"expectedStatusCodes"`
+	ExpectedClasses     []string `mapstructure:"expectedClasses"`
+}
+
+// OtherTransactionRuleConfig matches a root span when all the triggers that are set match:
+// one of the span kinds (internal, client, producer, unspecified), the instrumentation scope
+// name against a regular expression, or the presence of a marker attribute.
+type OtherTransactionRuleConfig struct {
+	Category  string   `mapstructure:"category"`
+	SpanKinds []string `mapstructure:"spanKinds"`
+	ScopeName string   `mapstructure:"scopeName"`
+	Attribute string   `mapstructure:"attribute"`
+}
+
+// CardinalityLimitsConfig sets how many distinct names a service can use within a window,
+// zero means no limit. Names over the limit are recorded as overflow.
+type CardinalityLimitsConfig struct {
+	MaxTransactionNames int           `mapstructure:"maxTransactionNames"`
+	MaxSegmentNames     int           `mapstructure:"maxSegmentNames"`
+	Window              time.Duration `mapstructure:"window"`
+}
+
+// NamingRuleConfig is a rule applied to transaction url paths. A regex rule replaces what
+// Match matches with Replacement. When the rule matches, Ignore drops the transaction and
+// Terminate skips the rules that follow.
+type NamingRuleConfig struct {
+	Type        NamingRuleType `mapstructure:"type"`
+	Match       string         `mapstructure:"match"`
+	Replacement string         `mapstructure:"replacement"`
+	Ignore      bool           `mapstructure:"ignore"`
+	Terminate   bool           `mapstructure:"terminate"`
+}
+
+// ResourceAttributesConfig lists the resource attributes kept on the metrics. Include and
+// Exclude take attribute names or glob patterns such as "k8s.*", an attribute is kept when
+// it is included and not excluded. Rename maps a kept attribute to the name it is sent with,
+// and Derived maps an attribute to the resource attribute it is copied from when it is missing.
+// Include and Derived replace DefaultResourceAttributes and DefaultDerivedResourceAttributes when set.
+type ResourceAttributesConfig struct {
+	Include []string          `mapstructure:"include"`
+	Exclude []string          `mapstructure:"exclude"`
+	Rename  map[string]string `mapstructure:"rename"`
+	Derived map[string]string `mapstructure:"derived"`
+}
+
+// TraceBufferConfig controls how long the metric connector holds on to spans
+// before turning them into transactions. A zero DecisionWait disables the buffer
+// and every batch is converted on its own.
+type TraceBufferConfig struct {
+	DecisionWait   time.Duration  `mapstructure:"decisionWait"`
+	MaxTraces      int            `mapstructure:"maxTraces"`
+	EvictionPolicy EvictionPolicy `mapstructure:"evictionPolicy"`
+}
+
+// MetricsConfig controls how the data points of the APM metrics are aggregated.
+// Points with the same metric name and attributes are merged until the metrics are
+// flushed: after every batch, or every FlushInterval when it is set.
+type MetricsConfig struct {
+	FlushInterval time.Duration `mapstructure:"flushInterval"`
+	// explicit bucket boundaries in seconds, for the histograms not listed in MetricHistogramBuckets
+	HistogramBuckets       []float64            `mapstructure:"histogramBuckets"`
+	MetricHistogramBuckets map[string][]float64 `mapstructure:"metricHistogramBuckets"`
+	// HistogramType selects how the latency metrics (transaction, datastore and external
+	// durations) are sent, the other histograms always use explicit buckets
+	HistogramType        HistogramType              `mapstructure:"histogramType"`
+	ExponentialHistogram ExponentialHistogramConfig `mapstructure:"exponentialHistogram"`
+	// CounterTemporality of the apdex, error and instance counters. Cumulative counters keep
+	// their value across flushes, and are reset when not updated for CounterStaleness.
+	CounterTemporality Temporality   `mapstructure:"counterTemporality"`
+	CounterStaleness   time.Duration `mapstructure:"counterStaleness"`
+}
+
+type Temporality string
+
+const (
+	DeltaTemporality      Temporality = "delta"
+	CumulativeTemporality Temporality = "cumulative"
+)
+
+type HistogramType string
+
+const (
+	ExplicitHistogramType    HistogramType = "explicit"
+	ExponentialHistogramType HistogramType = "exponential"
+)
+
+type ExponentialHistogramConfig struct {
+	MaxScale int32 `mapstructure:"maxScale"`
+	MaxSize  int   `mapstructure:"maxSize"`
+}
+
+// GetHistogramBuckets returns the explicit bucket boundaries of a histogram metric
+func (config MetricsConfig) GetHistogramBuckets(metricName string) []float64 {
+	if buckets, exists := config.MetricHistogramBuckets[metricName]; exists {
+		return buckets
+	}
+	return config.HistogramBuckets
+}
+
+func (cfg *Config) Validate() error {
+	if cfg.TraceBuffer.DecisionWait < 0 {
+		return fmt.Errorf("traceBuffer.decisionWait must not be negative")
+	}
+	if cfg.TraceBuffer.MaxTraces < 0 {
+		return fmt.Errorf("traceBuffer.maxTraces must not be negative")
+	}
+	switch cfg.TraceBuffer.EvictionPolicy {
+	case "", EvictionPolicyProcess, EvictionPolicyDrop:
+	default:
+		return fmt.Errorf("unknown traceBuffer.evictionPolicy: %s", cfg.TraceBuffer.EvictionPolicy)
+	}
+	if cfg.Metrics.FlushInterval < 0 {
+		return fmt.Errorf("metrics.flushInterval must not be negative")
+	}
+	if !sort.Float64sAreSorted(cfg.Metrics.HistogramBuckets) {
+		return fmt.Errorf("metrics.histogramBuckets must be sorted")
+	}
+	switch cfg.Metrics.HistogramType {
+	case "", ExplicitHistogramType:
+	case ExponentialHistogramType:
+		if cfg.Metrics.ExponentialHistogram.MaxScale < minExponentialHistogramScale || cfg.Metrics.ExponentialHistogram.MaxScale > 20 {
+			return fmt.Errorf("metrics.exponentialHistogram.maxScale must be between %d and 20", minExponentialHistogramScale)
+		}
+		if cfg.Metrics.ExponentialHistogram.MaxSize < 1 {
+			return fmt.Errorf("metrics.exponentialHistogram.maxSize must be positive")
+		}
+	default:
+		return fmt.Errorf("unknown metrics.histogramType: %s", cfg.Metrics.HistogramType)
+	}
+	switch cfg.Metrics.CounterTemporality {
+	case "", DeltaTemporality, CumulativeTemporality:
+	default:
+		return fmt.Errorf("unknown metrics.counterTemporality: %s", cfg.Metrics.CounterTemporality)
+	}
+	if cfg.Metrics.CounterStaleness < 0 {
+		return fmt.Errorf("metrics.counterStaleness must not be negative")
+	}
+	for _, pattern := range append(append([]string{}, cfg.ResourceAttributes.Include...), cfg.ResourceAttributes.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid resourceAttributes pattern %s: %w", pattern, err)
+		}
+	}
+	if cfg.CardinalityLimits.MaxTransactionNames < 0 || cfg.CardinalityLimits.MaxSegmentNames < 0 {
+		return fmt.Errorf("cardinalityLimits must not be negative")
+	}
+	if (cfg.CardinalityLimits.MaxTransactionNames > 0 || cfg.CardinalityLimits.MaxSegmentNames > 0) && cfg.CardinalityLimits.Window <= 0 {
+		return fmt.Errorf("cardinalityLimits.window must be positive when a limit is set")
+	}
+	switch cfg.SqlObfuscation {
+	case "", SqlObfuscationOff, SqlObfuscationObfuscate, SqlObfuscationDrop:
+	default:
+		return fmt.Errorf("unknown sqlObfuscation: %s", cfg.SqlObfuscation)
+	}
+	switch cfg.LogsOutput {
+	case "", LogsOutputTransactions, LogsOutputSpans, LogsOutputAll:
+	default:
+		return fmt.Errorf("unknown logsOutput: %s", cfg.LogsOutput)
+	}
+	if cfg.TransactionTraces.Threshold < 0 {
+		return fmt.Errorf("transactionTraces.threshold must not be negative")
+	}
+	if cfg.TransactionTraces.Enabled && cfg.TransactionTraces.HarvestInterval <= 0 {
+		return fmt.Errorf("transactionTraces.harvestInterval must be positive")
+	}
+	if cfg.TransactionTraces.Enabled && cfg.TransactionTraces.MaxTraces <= 0 {
+		return fmt.Errorf("transactionTraces.maxTraces must be positive")
+	}
+	if _, err := NewErrorClassifier(cfg.Errors); err != nil {
+		return err
+	}
+	if _, err := NewTransactionNamer(cfg.NamingRules, cfg.OtherTransactionRules); err != nil {
+		return err
+	}
+	for metricName, buckets := range cfg.Metrics.MetricHistogramBuckets {
+		if !sort.Float64sAreSorted(buckets) {
+			return fmt.Errorf("metrics.metricHistogramBuckets of %s must be sorted", metricName)
+		}
+	}
+	return nil
 }
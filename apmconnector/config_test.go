@@ -0,0 +1,107 @@
+package apmconnector
+
+import (
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/collector/confmap"
+	"testing"
+)
+
+func TestDefaultConfigIsValid(t *testing.T) {
+	assert.NoError(t, createDefaultConfig().(*Config).Validate())
+}
+
+func TestValidateEvictionPolicy(t *testing.T) {
+	config := createDefaultConfig().(*Config)
+	config.TraceBuffer.EvictionPolicy = "keep"
+	assert.Error(t, config.Validate())
+}
+
+func TestValidateHistogramBuckets(t *testing.T) {
+	config := createDefaultConfig().(*Config)
+	config.Metrics.MetricHistogramBuckets = map[string][]float64{"apm.service.transaction.duration": {1, 0.5}}
+	assert.Error(t, config.Validate())
+}
+
+func TestValidateCounterTemporality(t *testing.T) {
+	config := createDefaultConfig().(*Config)
+	config.Metrics.CounterTemporality = "sometimes"
+	assert.Error(t, config.Validate())
+}
+
+func TestValidateResourceAttributePatterns(t *testing.T) {
+	config := createDefaultConfig().(*Config)
+	config.ResourceAttributes.Include = []string{"k8s.[*"}
+	assert.Error(t, config.Validate())
+}
+
+func TestValidateNamingRules(t *testing.T) {
+	config := createDefaultConfig().(*Config)
+	config.NamingRules = append(config.NamingRules, NamingRuleConfig{Match: "users/("})
+	assert.Error(t, config.Validate())
+}
+
+func TestValidateSqlObfuscation(t *testing.T) {
+	config := createDefaultConfig().(*Config)
+	config.SqlObfuscation = "redact"
+	assert.Error(t, config.Validate())
+}
+
+func TestValidateErrorRules(t *testing.T) {
+	config := createDefaultConfig().(*Config)
+	config.Errors.IgnoreStatusCodes = []string{"4xx"}
+	assert.Error(t, config.Validate())
+}
+
+func TestValidateLogsOutput(t *testing.T) {
+	config := createDefaultConfig().(*Config)
+	config.LogsOutput = "events"
+	assert.Error(t, config.Validate())
+}
+
+func TestValidateTransactionTraces(t *testing.T) {
+	config := createDefaultConfig().(*Config)
+	config.TransactionTraces.HarvestInterval = 0
+	assert.Error(t, config.Validate())
+
+	config = createDefaultConfig().(*Config)
+	config.TransactionTraces.MaxTraces = 0
+	assert.Error(t, config.Validate())
+}
+
+func TestUnmarshalKeepsDefaultResourceAttributes(t *testing.T) {
+	defaultInclude := append([]string(nil), DefaultResourceAttributes...)
+	defaultDerived := make(map[string]string)
+	for name, source := range DefaultDerivedResourceAttributes {
+		defaultDerived[name] = source
+	}
+
+	for i := 0; i < 2; i++ {
+		config := createDefaultConfig().(*Config)
+		conf := confmap.NewFromStringMap(map[string]any{
+			"resourceAttributes": map[string]any{
+				"include": []any{"service.name"},
+				"derived": map[string]any{"x": "y"},
+			},
+		})
+		assert.NoError(t, conf.Unmarshal(config))
+		assert.Equal(t, []string{"service.name"}, config.ResourceAttributes.Include)
+		assert.Equal(t, map[string]string{"x": "y"}, config.ResourceAttributes.Derived)
+	}
+	assert.Equal(t, defaultInclude, DefaultResourceAttributes)
+	assert.Equal(t, defaultDerived, DefaultDerivedResourceAttributes)
+}
+
+func TestUnmarshalKeepsDefaultHistogramBuckets(t *testing.T) {
+	defaultBuckets := append([]float64(nil), DefaultHistogramBuckets...)
+	config := createDefaultConfig().(*Config)
+	conf := confmap.NewFromStringMap(map[string]any{"metrics": map[string]any{"histogramBuckets": []any{1, 2}}})
+	assert.NoError(t, conf.Unmarshal(config))
+	assert.Equal(t, []float64{1, 2}, config.Metrics.HistogramBuckets)
+	assert.Equal(t, defaultBuckets, DefaultHistogramBuckets)
+}
+
+func TestValidateCardinalityLimitsWindow(t *testing.T) {
+	config := createDefaultConfig().(*Config)
+	config.CardinalityLimits.Window = 0
+	assert.Error(t, config.Validate())
+}
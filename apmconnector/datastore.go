@@ -0,0 +1,224 @@
+package apmconnector
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+)
+
+const (
+	AwsDynamoDbTableNamesAttributeName       = "aws.dynamodb.table_names"
+	ElasticsearchPathPartsIndexAttributeName = "db.elasticsearch.path_parts.index"
+)
+
+// systems whose statements are not SQL, and must not go through the SQL parser
+var nonSqlDbSystems = map[string]bool{
+	"redis":         true,
+	"memcached":     true,
+	"mongodb":       true,
+	"elasticsearch": true,
+	"opensearch":    true,
+	"dynamodb":      true,
+	"couchdb":       true,
+}
+
+// DatastoreCall is what a database span does: the operation, and the table (or collection,
+// index...) it is run on. The table is empty when the system has none or it is not known.
+type DatastoreCall struct {
+	Operation string
+	Table     string
+}
+
+// GetDatastoreCall extracts the operation and table of a database span. The operation comes
+// from db.operation, or else from the statement or the span name, which starts with the operation.
+func GetDatastoreCall(sqlParser *SqlParser, span ptrace.Span, dbSystem string) DatastoreCall {
+	var call DatastoreCall
+	if collection, exists := DbCollectionAttribute.Get(span.Attributes()); exists {
+		call.Table = collection.AsString()
+	}
+	if operation, exists := DbOperationAttribute.Get(span.Attributes()); exists {
+		call.Operation = operation.AsString()
+	}
+
+	switch dbSystem {
+	case "dynamodb":
+		if call.Table == "" {
+			call.Table = getDynamoDbTable(span)
+		}
+		if rpcMethod, exists := span.Attributes().Get(RpcMethodAttributeName); exists && call.Operation == "" {
+			call.Operation = rpcMethod.AsString()
+		}
+	case "elasticsearch", "opensearch":
+		if call.Table == "" {
+			call.Table = getElasticsearchIndex(span)
+		}
+	case "redis", "memcached":
+		// the statement starts with the command: GET key
+		if statement, exists := DbQueryTextAttribute.Get(span.Attributes()); exists && call.Operation == "" {
+			call.Operation = firstWord(statement.AsString())
+		}
+	}
+
+	if !nonSqlDbSystems[dbSystem] && (call.Operation == "" || call.Table == "") {
+		if statement, parsed := sqlParser.ParseSpanStatement(span); parsed {
+			if call.Operation == "" {
+				call.Operation = statement.Operation
+			}
+			if call.Table == "" {
+				call.Table = statement.Table
+			}
+		}
+	}
+	if call.Operation == "" {
+		call.Operation = firstWord(span.Name())
+	}
+	return call
+}
+
+// getDynamoDbTable returns the first table of aws.dynamodb.table_names, which is a list
+func getDynamoDbTable(span ptrace.Span) string {
+	tableNames, exists := span.Attributes().Get(AwsDynamoDbTableNamesAttributeName)
+	if !exists {
+		return ""
+	}
+	if tableNames.Type() == pcommon.ValueTypeSlice {
+		if tableNames.Slice().Len() == 0 {
+			return ""
+		}
+		return tableNames.Slice().At(0).AsString()
+	}
+	return tableNames.AsString()
+}
+
+// getElasticsearchIndex returns the index of a request, the first segment of the url path
+// unless it is an endpoint such as /_search
+func getElasticsearchIndex(span ptrace.Span) string {
+	if index, exists := span.Attributes().Get(ElasticsearchPathPartsIndexAttributeName); exists {
+		return index.AsString()
+	}
+	fullUrl, exists := UrlFullAttribute.Get(span.Attributes())
+	if !exists {
+		return ""
+	}
+	parsedUrl, err := url.Parse(fullUrl.AsString())
+	if err != nil {
+		return ""
+	}
+	index, _, _ := strings.Cut(strings.TrimPrefix(parsedUrl.Path, "/"), "/")
+	if strings.HasPrefix(index, "_") {
+		return ""
+	}
+	return index
+}
+
+func firstWord(s string) string {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[0]
+}
+
+const (
+	DbConnectionStringAttributeName = "db.connection_string"
+	unknownPortOrPath               = "unknown"
+)
+
+var localHostNames = map[string]bool{
+	"localhost":       true,
+	"127.0.0.1":       true,
+	"0.0.0.0":         true,
+	"::1":             true,
+	"::":              true,
+	"0:0:0:0:0:0:0:1": true,
+	"0:0:0:0:0:0:0:0": true,
+}
+
+// DatastoreInstance is the server, or the file, a database call is sent to
+type DatastoreInstance struct {
+	System     string
+	Host       string
+	PortOrPath string
+}
+
+func (instance DatastoreInstance) TimesliceName() string {
+	return fmt.Sprintf("Datastore/instance/%s/%s/%s", instance.System, instance.Host, instance.PortOrPath)
+}
+
+// GetDatastoreInstance returns the instance of a database span from server.address and server.port,
+// or else from db.connection_string. It returns nil when the host is not known. Local addresses
+// are replaced with the name of the reporting host, so that the instances of several hosts differ.
+func GetDatastoreInstance(span ptrace.Span, dbSystem string, hostName string) *DatastoreInstance {
+	instance := &DatastoreInstance{System: dbSystem, PortOrPath: unknownPortOrPath}
+	if serverAddress, exists := ServerAddressAttribute.Get(span.Attributes()); exists {
+		instance.Host = serverAddress.AsString()
+		if serverPort, exists := ServerPortAttribute.Get(span.Attributes()); exists {
+			instance.PortOrPath = serverPort.AsString()
+		}
+	} else if connectionString, exists := span.Attributes().Get(DbConnectionStringAttributeName); exists {
+		instance.Host, instance.PortOrPath = parseConnectionString(connectionString.AsString())
+	}
+	if instance.Host == "" {
+		return nil
+	}
+	if localHostNames[strings.ToLower(instance.Host)] && hostName != "" {
+		instance.Host = hostName
+	}
+	if instance.PortOrPath == "" {
+		instance.PortOrPath = unknownPortOrPath
+	}
+	return instance
+}
+
+// parseConnectionString returns the host and the port or path of a connection string. It can be
+// a url (postgresql://host:5432/db, jdbc:mysql://host/db), key value pairs (Server=host,1433;...)
+// or the path of a file database.
+func parseConnectionString(connectionString string) (string, string) {
+	connectionString = strings.TrimPrefix(strings.TrimSpace(connectionString), "jdbc:")
+	if strings.HasPrefix(connectionString, "/") || strings.HasPrefix(connectionString, "file:") {
+		return "localhost", strings.TrimPrefix(connectionString, "file:")
+	}
+	if strings.Contains(connectionString, "://") {
+		parsedUrl, err := url.Parse(connectionString)
+		if err != nil {
+			return "", ""
+		}
+		// mongodb://host1:27017,host2:27017/db lists several hosts, keep the first one
+		host, _, _ := strings.Cut(parsedUrl.Host, ",")
+		parsedHost, err := url.Parse("//" + host)
+		if err != nil {
+			return "", ""
+		}
+		if parsedUrl.Scheme == "sqlite" || parsedUrl.Scheme == "file" {
+			return "localhost", parsedUrl.Path
+		}
+		return parsedHost.Hostname(), parsedHost.Port()
+	}
+	host, portOrPath := "", ""
+	for _, pair := range strings.Split(connectionString, ";") {
+		key, value, _ := strings.Cut(pair, "=")
+		value = strings.TrimSpace(value)
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "server", "data source", "host", "address", "addr":
+			// MSSQL: tcp:host,1433 or host\instance
+			host = strings.TrimPrefix(value, "tcp:")
+			if strings.HasPrefix(host, "/") {
+				// SQLite: Data Source=/var/app.db
+				host, portOrPath = "localhost", host
+				continue
+			}
+			for _, separator := range []string{",", `\`, ":"} {
+				if name, port, found := strings.Cut(host, separator); found {
+					host, portOrPath = name, strings.TrimSpace(port)
+					break
+				}
+			}
+		case "port":
+			portOrPath = value
+		}
+	}
+	return host, portOrPath
+}
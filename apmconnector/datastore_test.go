@@ -0,0 +1,145 @@
+package apmconnector
+
+import (
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+	"testing"
+)
+
+func TestGetDatastoreCall(t *testing.T) {
+	tests := []struct {
+		name       string
+		spanName   string
+		attributes map[string]string
+		call       DatastoreCall
+	}{
+		{"redis command", "GET", map[string]string{"db.system": "redis", "db.statement": "GET session:12"},
+			DatastoreCall{Operation: "GET"}},
+		{"redis without statement", "HMSET", map[string]string{"db.system": "redis"},
+			DatastoreCall{Operation: "HMSET"}},
+		{"mongodb", "find shop.orders", map[string]string{"db.system": "mongodb", "db.operation": "find", "db.mongodb.collection": "orders"},
+			DatastoreCall{Operation: "find", Table: "orders"}},
+		{"mongodb without operation", "aggregate shop.orders", map[string]string{"db.system": "mongodb", "db.collection.name": "orders"},
+			DatastoreCall{Operation: "aggregate", Table: "orders"}},
+		{"cassandra", "SELECT shop.carts", map[string]string{"db.system": "cassandra", "db.cassandra.table": "carts", "db.statement": "SELECT * FROM carts WHERE id = ?"},
+			DatastoreCall{Operation: "SELECT", Table: "carts"}},
+		{"cassandra statement", "query", map[string]string{"db.system": "cassandra", "db.statement": "INSERT INTO shop.carts (id) VALUES (?)"},
+			DatastoreCall{Operation: "INSERT", Table: "shop.carts"}},
+		{"elasticsearch", "search", map[string]string{"db.system": "elasticsearch", "db.operation": "search", "url.full": "http://es:9200/products/_search?q=shoes"},
+			DatastoreCall{Operation: "search", Table: "products"}},
+		{"elasticsearch endpoint", "cluster.health", map[string]string{"db.system": "elasticsearch", "http.url": "http://es:9200/_cluster/health"},
+			DatastoreCall{Operation: "cluster.health"}},
+		{"elasticsearch path parts", "index", map[string]string{"db.system": "elasticsearch", "db.elasticsearch.path_parts.index": "logs"},
+			DatastoreCall{Operation: "index", Table: "logs"}},
+		{"dynamodb", "DynamoDB.GetItem", map[string]string{"db.system": "dynamodb", "rpc.method": "GetItem"},
+			DatastoreCall{Operation: "GetItem"}},
+	}
+	for _, test := range tests {
+		span := ptrace.NewSpan()
+		span.SetName(test.spanName)
+		putStrs(span.Attributes(), test.attributes)
+		system, _ := span.Attributes().Get("db.system")
+		assert.Equal(t, test.call, GetDatastoreCall(NewSqlParser(), span, system.Str()), test.name)
+	}
+}
+
+func TestGetDatastoreCallDynamoDbTables(t *testing.T) {
+	span := ptrace.NewSpan()
+	span.Attributes().PutStr("db.operation", "BatchGetItem")
+	tables := span.Attributes().PutEmptySlice("aws.dynamodb.table_names")
+	tables.AppendEmpty().SetStr("users")
+	tables.AppendEmpty().SetStr("orders")
+
+	assert.Equal(t, DatastoreCall{Operation: "BatchGetItem", Table: "users"}, GetDatastoreCall(NewSqlParser(), span, "dynamodb"))
+}
+
+func TestDatastoreOperationTimeslice(t *testing.T) {
+	transactions := NewTransactionsMap(0.5, &TransactionNamer{}, nil, nil)
+	metrics := NewMeterProvider(MetricsConfig{}).getOrCreateResourceMetrics(pcommon.NewMap())
+
+	root := newTimedTestSpan([8]byte{1}, [8]byte{}, ptrace.SpanKindServer, 0, 100)
+	redis := newTimedTestSpan([8]byte{2}, [8]byte{1}, ptrace.SpanKindClient, 10, 20)
+	redis.Attributes().PutStr("db.system", "redis")
+	redis.Attributes().PutStr("db.statement", "GET session:12")
+	mongo := newTimedTestSpan([8]byte{3}, [8]byte{1}, ptrace.SpanKindClient, 20, 30)
+	mongo.Attributes().PutStr("db.system", "mongodb")
+	mongo.Attributes().PutStr("db.operation", "find")
+	mongo.Attributes().PutStr("db.mongodb.collection", "orders")
+
+	for _, span := range []ptrace.Span{root, redis, mongo} {
+		transactions.IndexSpan(span, metrics)
+	}
+	for _, span := range []ptrace.Span{root, redis, mongo} {
+		transaction, _ := transactions.GetOrCreateTransaction("java", span, metrics)
+		transaction.AddSpan(span, pcommon.NewInstrumentationScope())
+	}
+	for _, transaction := range transactions.Transactions {
+		assert.Equal(t, "Datastore/operation/redis/GET", transaction.Measurements[redis.SpanID().String()].MetricTimesliceName)
+		assert.Equal(t, "Datastore/statement/mongodb/orders/find", transaction.Measurements[mongo.SpanID().String()].MetricTimesliceName)
+	}
+}
+
+func TestGetDatastoreInstance(t *testing.T) {
+	tests := []struct {
+		name       string
+		attributes map[string]string
+		instance   *DatastoreInstance
+	}{
+		{"server address", map[string]string{"server.address": "db-replica-2", "server.port": "5432"},
+			&DatastoreInstance{System: "postgresql", Host: "db-replica-2", PortOrPath: "5432"}},
+		{"net peer", map[string]string{"net.peer.name": "db1", "net.peer.port": "3306"},
+			&DatastoreInstance{System: "postgresql", Host: "db1", PortOrPath: "3306"}},
+		{"no port", map[string]string{"server.address": "db1"},
+			&DatastoreInstance{System: "postgresql", Host: "db1", PortOrPath: "unknown"}},
+		{"localhost", map[string]string{"server.address": "127.0.0.1", "server.port": "5432"},
+			&DatastoreInstance{System: "postgresql", Host: "web-1", PortOrPath: "5432"}},
+		{"url", map[string]string{"db.connection_string": "jdbc:postgresql://db2.internal:6432/shop"},
+			&DatastoreInstance{System: "postgresql", Host: "db2.internal", PortOrPath: "6432"}},
+		{"several hosts", map[string]string{"db.connection_string": "mongodb://mongo1:27017,mongo2:27017/shop"},
+			&DatastoreInstance{System: "postgresql", Host: "mongo1", PortOrPath: "27017"}},
+		{"key value", map[string]string{"db.connection_string": "Server=tcp:sql1,1433;Database=shop;"},
+			&DatastoreInstance{System: "postgresql", Host: "sql1", PortOrPath: "1433"}},
+		{"named instance", map[string]string{"db.connection_string": `Data Source=sql1\REPORTS;Initial Catalog=shop`},
+			&DatastoreInstance{System: "postgresql", Host: "sql1", PortOrPath: "REPORTS"}},
+		{"separate port", map[string]string{"db.connection_string": "Host=localhost;Port=5433;Database=shop"},
+			&DatastoreInstance{System: "postgresql", Host: "web-1", PortOrPath: "5433"}},
+		{"file", map[string]string{"db.connection_string": "/var/lib/app/app.db"},
+			&DatastoreInstance{System: "postgresql", Host: "web-1", PortOrPath: "/var/lib/app/app.db"}},
+		{"unknown", map[string]string{"db.name": "shop"}, nil},
+	}
+	for _, test := range tests {
+		span := ptrace.NewSpan()
+		putStrs(span.Attributes(), test.attributes)
+		assert.Equal(t, test.instance, GetDatastoreInstance(span, "postgresql", "web-1"), test.name)
+	}
+}
+
+func TestDatastoreInstanceMetric(t *testing.T) {
+	transactions := NewTransactionsMap(0.5, &TransactionNamer{}, nil, nil)
+	resourceAttributes := pcommon.NewMap()
+	resourceAttributes.PutStr("host.name", "web-1")
+	metrics := NewMeterProvider(MetricsConfig{}).getOrCreateResourceMetrics(resourceAttributes)
+
+	root := newTimedTestSpan([8]byte{1}, [8]byte{}, ptrace.SpanKindServer, 0, 100)
+	db := newTimedTestSpan([8]byte{2}, [8]byte{1}, ptrace.SpanKindClient, 10, 20)
+	db.Attributes().PutStr("db.system", "redis")
+	db.Attributes().PutStr("db.operation", "GET")
+	db.Attributes().PutStr("server.address", "localhost")
+	db.Attributes().PutInt("server.port", 6379)
+
+	for _, span := range []ptrace.Span{root, db} {
+		transactions.IndexSpan(span, metrics)
+	}
+	for _, span := range []ptrace.Span{root, db} {
+		transaction, _ := transactions.GetOrCreateTransaction("java", span, metrics)
+		transaction.AddSpan(span, pcommon.NewInstrumentationScope())
+	}
+	transactions.ProcessTransactions()
+
+	dataPoints := metrics.nameToMetric["apm.service.datastore.instance.duration"].Histogram().DataPoints()
+	assert.Equal(t, 1, dataPoints.Len())
+	name, _ := dataPoints.At(0).Attributes().Get("metricTimesliceName")
+	assert.Equal(t, "Datastore/instance/redis/web-1/6379", name.AsString())
+	assert.Equal(t, 10e-9, dataPoints.At(0).Sum())
+}
@@ -0,0 +1,139 @@
+package apmconnector
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"go.opentelemetry.io/collector/pdata/ptrace"
+)
+
+// ErrorClassification is how the error of a span is counted
+type ErrorClassification int
+
+const (
+	NotAnError ErrorClassification = iota
+	// UnexpectedError is counted as a transaction error, and its transaction is frustrating for apdex
+	UnexpectedError
+	// ExpectedError is counted apart, and does not change apdex
+	ExpectedError
+)
+
+// statusCodeRange is an inclusive range of status codes
+type statusCodeRange struct {
+	min, max int64
+}
+
+func (codeRange statusCodeRange) contains(code int64) bool {
+	return code >= codeRange.min && code <= codeRange.max
+}
+
+// ErrorClassifier decides whether a span is an error from its status, its http status code and
+// the class of its exception, with the error rules of the configuration
+type ErrorClassifier struct {
+	errorStatusCodes    []statusCodeRange
+	ignoreStatusCodes   []statusCodeRange
+	expectedStatusCodes []statusCodeRange
+	ignoreClasses       map[string]bool
+	expectedClasses     map[string]bool
+}
+
+func NewErrorClassifier(config ErrorRulesConfig) (*ErrorClassifier, error) {
+	classifier := &ErrorClassifier{ignoreClasses: make(map[string]bool), expectedClasses: make(map[string]bool)}
+	var err error
+	if classifier.errorStatusCodes, err = parseStatusCodeRanges(config.ErrorStatusCodes); err != nil {
+		return nil, fmt.Errorf("invalid errors.errorStatusCodes: %w", err)
+	}
+	if classifier.ignoreStatusCodes, err = parseStatusCodeRanges(config.IgnoreStatusCodes); err != nil {
+		return nil, fmt.Errorf("invalid errors.ignoreStatusCodes: %w", err)
+	}
+	if classifier.expectedStatusCodes, err = parseStatusCodeRanges(config.ExpectedStatusCodes); err != nil {
+		return nil, fmt.Errorf("invalid errors.expectedStatusCodes: %w", err)
+	}
+	for _, class := range config.IgnoreClasses {
+		classifier.ignoreClasses[class] = true
+	}
+	for _, class := range config.ExpectedClasses {
+		classifier.expectedClasses[class] = true
+	}
+	return classifier, nil
+}
+
+// parseStatusCodeRanges parses codes such as "404" and ranges such as "500-599"
+func parseStatusCodeRanges(ranges []string) ([]statusCodeRange, error) {
+	parsed := make([]statusCodeRange, 0, len(ranges))
+	for _, codes := range ranges {
+		minCode, maxCode, isRange := strings.Cut(codes, "-")
+		if !isRange {
+			maxCode = minCode
+		}
+		min, err := strconv.ParseInt(strings.TrimSpace(minCode), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid status code range %s", codes)
+		}
+		max, err := strconv.ParseInt(strings.TrimSpace(maxCode), 10, 64)
+		if err != nil || max < min {
+			return nil, fmt.Errorf("invalid status code range %s", codes)
+		}
+		parsed = append(parsed, statusCodeRange{min: min, max: max})
+	}
+	return parsed, nil
+}
+
+func matchesStatusCode(ranges []statusCodeRange, code int64) bool {
+	for _, codeRange := range ranges {
+		if codeRange.contains(code) {
+			return true
+		}
+	}
+	return false
+}
+
+// Classify returns how an error of a span is counted. Without a classifier, only the spans with
+// an error status are errors.
+func (classifier *ErrorClassifier) Classify(span ptrace.Span) ErrorClassification {
+	if classifier == nil {
+		if IsErrorSpan(span) {
+			return UnexpectedError
+		}
+		return NotAnError
+	}
+
+	statusCode, hasStatusCode := GetHttpStatusCode(span)
+	if !IsErrorSpan(span) && !(hasStatusCode && matchesStatusCode(classifier.errorStatusCodes, statusCode)) {
+		return NotAnError
+	}
+	return classifier.ClassifyException(span)
+}
+
+// ClassifyException returns how the exception recorded on a span is counted. The exception is an
+// error whatever the status of the span, unless its class or the status code are ignored.
+func (classifier *ErrorClassifier) ClassifyException(span ptrace.Span) ErrorClassification {
+	if classifier == nil {
+		return UnexpectedError
+	}
+	statusCode, hasStatusCode := GetHttpStatusCode(span)
+	if hasStatusCode && matchesStatusCode(classifier.ignoreStatusCodes, statusCode) {
+		return NotAnError
+	}
+	exceptionClass := getExceptionClass(span)
+	if classifier.ignoreClasses[exceptionClass] {
+		return NotAnError
+	}
+	if classifier.expectedClasses[exceptionClass] || hasStatusCode && matchesStatusCode(classifier.expectedStatusCodes, statusCode) {
+		return ExpectedError
+	}
+	return UnexpectedError
+}
+
+// getExceptionClass returns the type of the last exception event of a span, or an empty string
+func getExceptionClass(span ptrace.Span) string {
+	exception, hasException := getLastException(span)
+	if !hasException {
+		return ""
+	}
+	if exceptionType, exists := exception.Get(ExceptionTypeAttributeName); exists {
+		return exceptionType.AsString()
+	}
+	return ""
+}
@@ -0,0 +1,86 @@
+package apmconnector
+
+import (
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+	"testing"
+)
+
+func newErrorTestSpan(statusCode int64, isError bool, exceptionType string) ptrace.Span {
+	span := newTimedTestSpan([8]byte{1}, [8]byte{}, ptrace.SpanKindServer, 0, 100)
+	if statusCode != 0 {
+		span.Attributes().PutInt("http.response.status_code", statusCode)
+	}
+	if isError {
+		span.Status().SetCode(ptrace.StatusCodeError)
+	}
+	if exceptionType != "" {
+		event := span.Events().AppendEmpty()
+		event.SetName("exception")
+		event.Attributes().PutStr("exception.type", exceptionType)
+	}
+	return span
+}
+
+func TestClassifyErrors(t *testing.T) {
+	classifier, err := NewErrorClassifier(ErrorRulesConfig{
+		ErrorStatusCodes:    []string{"500-599", "429"},
+		IgnoreStatusCodes:   []string{"503"},
+		IgnoreClasses:       []string{"io.grpc.StatusRuntimeException"},
+		ExpectedStatusCodes: []string{"502"},
+		ExpectedClasses:     []string{"ValidationError"},
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, NotAnError, classifier.Classify(newErrorTestSpan(200, false, "")))
+	assert.Equal(t, NotAnError, classifier.Classify(newErrorTestSpan(404, false, "")))
+	assert.Equal(t, UnexpectedError, classifier.Classify(newErrorTestSpan(0, true, "")))
+	assert.Equal(t, UnexpectedError, classifier.Classify(newErrorTestSpan(500, false, "")))
+	assert.Equal(t, UnexpectedError, classifier.Classify(newErrorTestSpan(429, false, "")))
+	assert.Equal(t, NotAnError, classifier.Classify(newErrorTestSpan(503, true, "")))
+	assert.Equal(t, NotAnError, classifier.Classify(newErrorTestSpan(0, true, "io.grpc.StatusRuntimeException")))
+	assert.Equal(t, ExpectedError, classifier.Classify(newErrorTestSpan(502, false, "")))
+	assert.Equal(t, ExpectedError, classifier.Classify(newErrorTestSpan(0, true, "ValidationError")))
+	// an exception is an error even when the span status is not
+	assert.Equal(t, UnexpectedError, classifier.ClassifyException(newErrorTestSpan(0, false, "KeyError")))
+	assert.Equal(t, NotAnError, classifier.ClassifyException(newErrorTestSpan(503, false, "KeyError")))
+}
+
+func TestClassifyErrorsWithoutClassifier(t *testing.T) {
+	var classifier *ErrorClassifier
+	assert.Equal(t, NotAnError, classifier.Classify(newErrorTestSpan(500, false, "")))
+	assert.Equal(t, UnexpectedError, classifier.Classify(newErrorTestSpan(0, true, "")))
+	assert.Equal(t, UnexpectedError, classifier.ClassifyException(newErrorTestSpan(0, false, "KeyError")))
+}
+
+func TestInvalidStatusCodeRanges(t *testing.T) {
+	for _, codes := range []string{"5xx", "599-500", "500-", ""} {
+		_, err := NewErrorClassifier(ErrorRulesConfig{IgnoreStatusCodes: []string{codes}})
+		assert.Error(t, err, codes)
+	}
+}
+
+func TestExpectedErrorKeepsApdex(t *testing.T) {
+	classifier, _ := NewErrorClassifier(ErrorRulesConfig{ErrorStatusCodes: []string{"500-599"}, ExpectedStatusCodes: []string{"503"}})
+	transactions := NewTransactionsMap(0.5, &TransactionNamer{}, nil, classifier)
+	metrics := NewMeterProvider(MetricsConfig{}).getOrCreateResourceMetrics(pcommon.NewMap())
+	scope := pcommon.NewInstrumentationScope()
+
+	span := newErrorTestSpan(503, true, "")
+	span.Attributes().PutStr("http.route", "/orders")
+	transactions.IndexSpan(span, metrics)
+	transaction, _ := transactions.GetOrCreateTransaction("java", span, metrics)
+	transaction.AddSpan(span, scope)
+	transactions.ProcessTransactions()
+
+	_, transactionError := metrics.nameToMetric["apm.service.error.count"]
+	assert.False(t, transactionError)
+	expected := metrics.nameToMetric["apm.service.transaction.error.expected.count"].Sum().DataPoints()
+	assert.Equal(t, 1, expected.Len())
+	name, _ := expected.At(0).Attributes().Get("transactionName")
+	assert.Equal(t, "WebTransaction/http.route/orders", name.AsString())
+	apdex := metrics.nameToMetric["apm.service.apdex"].Sum().DataPoints()
+	bucket, _ := apdex.At(0).Attributes().Get("apdex.bucket")
+	assert.Equal(t, "S", bucket.AsString())
+}
@@ -0,0 +1,109 @@
+package apmconnector
+
+import (
+	"math"
+
+	"go.opentelemetry.io/collector/pdata/pmetric"
+)
+
+const (
+	// lowest scale a histogram is downscaled to, each bucket then covers a factor of 2^1024
+	minExponentialHistogramScale = -10
+)
+
+// ExponentialHistogram aggregates values into base-2 exponential buckets. It starts at
+// the configured max scale and downscales whenever the values no longer fit in maxSize
+// buckets, so the resolution adapts to the range of the recorded durations.
+type ExponentialHistogram struct {
+	scale     int32
+	maxSize   int
+	zeroCount uint64
+	// index of the first bucket in counts
+	offset int32
+	counts []uint64
+}
+
+func NewExponentialHistogram(maxScale int32, maxSize int) *ExponentialHistogram {
+	if maxSize < 1 {
+		maxSize = 1
+	}
+	return &ExponentialHistogram{scale: maxScale, maxSize: maxSize}
+}
+
+func (histogram *ExponentialHistogram) Record(value float64) {
+	if value <= 0 {
+		histogram.zeroCount++
+		return
+	}
+
+	index := MapToExponentialIndex(value, histogram.scale)
+	if len(histogram.counts) == 0 {
+		histogram.offset = index
+		histogram.counts = []uint64{1}
+		return
+	}
+
+	low, high := histogram.offset, histogram.offset+int32(len(histogram.counts))-1
+	if index < low {
+		low = index
+	}
+	if index > high {
+		high = index
+	}
+	scaleChange := int32(0)
+	for int(high-low) >= histogram.maxSize && histogram.scale-scaleChange > minExponentialHistogramScale {
+		low >>= 1
+		high >>= 1
+		scaleChange++
+	}
+	if scaleChange > 0 {
+		histogram.downscale(scaleChange)
+		index = MapToExponentialIndex(value, histogram.scale)
+	}
+
+	if index < histogram.offset {
+		counts := make([]uint64, int(histogram.offset-index)+len(histogram.counts))
+		copy(counts[histogram.offset-index:], histogram.counts)
+		histogram.counts = counts
+		histogram.offset = index
+	} else if last := histogram.offset + int32(len(histogram.counts)) - 1; index > last {
+		histogram.counts = append(histogram.counts, make([]uint64, index-last)...)
+	}
+	histogram.counts[index-histogram.offset]++
+}
+
+// downscale merges the buckets so that each new bucket covers 2^change old buckets
+func (histogram *ExponentialHistogram) downscale(change int32) {
+	histogram.scale -= change
+	offset := histogram.offset >> change
+	counts := make([]uint64, int((histogram.offset+int32(len(histogram.counts))-1)>>change-offset)+1)
+	for i, count := range histogram.counts {
+		counts[(histogram.offset+int32(i))>>change-offset] += count
+	}
+	histogram.offset = offset
+	histogram.counts = counts
+}
+
+// CopyTo writes the buckets to an exponential histogram data point. Count, sum, min and
+// max are left to the caller.
+func (histogram *ExponentialHistogram) CopyTo(dp pmetric.ExponentialHistogramDataPoint) {
+	dp.SetScale(histogram.scale)
+	dp.SetZeroCount(histogram.zeroCount)
+	dp.Positive().SetOffset(histogram.offset)
+	dp.Positive().BucketCounts().FromRaw(histogram.counts)
+}
+
+// MapToExponentialIndex returns the index of the bucket holding value at the given scale.
+// Bucket i covers (2^(i/2^scale), 2^((i+1)/2^scale)].
+func MapToExponentialIndex(value float64, scale int32) int32 {
+	if scale <= 0 {
+		frac, exp := math.Frexp(value)
+		// value = frac * 2^exp with frac in [0.5, 1), exact powers of two are upper bounds
+		index := int32(exp - 1)
+		if frac == 0.5 {
+			index--
+		}
+		return index >> -scale
+	}
+	return int32(math.Ceil(math.Log2(value)*math.Ldexp(1, int(scale)))) - 1
+}
@@ -0,0 +1,75 @@
+package apmconnector
+
+import (
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+	"math"
+	"testing"
+)
+
+func TestMapToExponentialIndexScaleZero(t *testing.T) {
+	assert.Equal(t, int32(-1), MapToExponentialIndex(1, 0))
+	assert.Equal(t, int32(0), MapToExponentialIndex(1.5, 0))
+	assert.Equal(t, int32(0), MapToExponentialIndex(2, 0))
+	assert.Equal(t, int32(1), MapToExponentialIndex(3, 0))
+	assert.Equal(t, int32(-2), MapToExponentialIndex(0.5, 0))
+	assert.Equal(t, int32(-4), MapToExponentialIndex(0.1, 0))
+}
+
+func TestMapToExponentialIndexNegativeScale(t *testing.T) {
+	assert.Equal(t, int32(0), MapToExponentialIndex(4, -1))
+	assert.Equal(t, int32(1), MapToExponentialIndex(5, -1))
+	assert.Equal(t, int32(-1), MapToExponentialIndex(1, -1))
+}
+
+func TestMapToExponentialIndexPositiveScale(t *testing.T) {
+	assert.Equal(t, int32(-1), MapToExponentialIndex(1, 1))
+	assert.Equal(t, int32(0), MapToExponentialIndex(1.4, 1))
+	assert.Equal(t, int32(1), MapToExponentialIndex(1.5, 1))
+	assert.Equal(t, int32(1), MapToExponentialIndex(2, 1))
+}
+
+func TestExponentialHistogramRecord(t *testing.T) {
+	histogram := NewExponentialHistogram(0, 10)
+	for _, value := range []float64{0, 1, 1.5, 2, 3} {
+		histogram.Record(value)
+	}
+
+	dp := pmetric.NewExponentialHistogramDataPoint()
+	histogram.CopyTo(dp)
+	assert.Equal(t, int32(0), dp.Scale())
+	assert.Equal(t, uint64(1), dp.ZeroCount())
+	assert.Equal(t, int32(-1), dp.Positive().Offset())
+	assert.Equal(t, []uint64{1, 2, 1}, dp.Positive().BucketCounts().AsRaw())
+}
+
+func TestExponentialHistogramDownscale(t *testing.T) {
+	histogram := NewExponentialHistogram(20, 8)
+	values := []float64{0.001, 0.01, 0.02, 0.5, 1, 3, 10, 60}
+	for _, value := range values {
+		histogram.Record(value)
+	}
+
+	dp := pmetric.NewExponentialHistogramDataPoint()
+	histogram.CopyTo(dp)
+	assert.True(t, dp.Scale() < 20)
+	counts := dp.Positive().BucketCounts().AsRaw()
+	assert.True(t, len(counts) <= 8)
+
+	total := uint64(0)
+	for _, count := range counts {
+		total += count
+	}
+	assert.Equal(t, uint64(len(values)), total)
+
+	// every value lands in a bucket whose bounds contain it
+	base := math.Pow(2, math.Pow(2, -float64(dp.Scale())))
+	for _, value := range values {
+		index := MapToExponentialIndex(value, dp.Scale())
+		position := int(index - dp.Positive().Offset())
+		assert.True(t, position >= 0 && position < len(counts))
+		assert.True(t, counts[position] > 0)
+		assert.True(t, value > math.Pow(base, float64(index))*(1-1e-9))
+		assert.True(t, value <= math.Pow(base, float64(index+1))*(1+1e-9))
+	}
+}
@@ -4,6 +4,8 @@ package apmconnector // import "github.com/jlegoff/jdot/apmconnector"
 
 import (
 	"context"
+	"time"
+
 	"go.opentelemetry.io/collector/component"
 	"go.opentelemetry.io/collector/connector"
 	"go.opentelemetry.io/collector/consumer"
@@ -27,7 +29,42 @@ func NewFactory() connector.Factory {
 
 // createDefaultConfig creates the default configuration.
 func createDefaultConfig() component.Config {
-	return &Config{}
+	return &Config{
+		TraceBuffer: TraceBufferConfig{
+			DecisionWait:   5 * time.Second,
+			MaxTraces:      10000,
+			EvictionPolicy: EvictionPolicyProcess,
+		},
+		Metrics: MetricsConfig{
+			HistogramBuckets: append([]float64(nil), DefaultHistogramBuckets...),
+			HistogramType:    ExplicitHistogramType,
+			ExponentialHistogram: ExponentialHistogramConfig{
+				MaxScale: 20,
+				MaxSize:  160,
+			},
+			CounterTemporality: DeltaTemporality,
+			CounterStaleness:   5 * time.Minute,
+		},
+		NamingRules: []NamingRuleConfig{
+			{Type: QueryStringNamingRule},
+			{Type: IdSegmentsNamingRule},
+		},
+		CardinalityLimits: CardinalityLimitsConfig{
+			MaxTransactionNames: 1000,
+			MaxSegmentNames:     2000,
+			Window:              time.Hour,
+		},
+		SqlObfuscation: SqlObfuscationObfuscate,
+		Errors: ErrorRulesConfig{
+			ErrorStatusCodes: []string{"500-599"},
+		},
+		LogsOutput: LogsOutputTransactions,
+		TransactionTraces: TransactionTracesConfig{
+			Enabled:         true,
+			HarvestInterval: time.Minute,
+			MaxTraces:       100,
+		},
+	}
 }
 
 // createTracesToMetrics creates a traces to metrics connector based on provided config.
@@ -39,9 +76,15 @@ func createTracesToMetrics(
 ) (connector.Traces, error) {
 	c := cfg.(*Config)
 
+	metricsBuilder, err := NewMetricsBuilder(set.Logger, c)
+	if err != nil {
+		return nil, err
+	}
+
 	return &ApmMetricConnector{
 		config:          c,
 		metricsConsumer: nextConsumer,
+		metricsBuilder:  metricsBuilder,
 		logger:          set.Logger,
 	}, nil
 }
@@ -55,10 +98,21 @@ func createTracesToLogs(
 ) (connector.Traces, error) {
 	c := cfg.(*Config)
 
+	namer, err := NewTransactionNamer(c.NamingRules, c.OtherTransactionRules)
+	if err != nil {
+		return nil, err
+	}
+	errorClassifier, err := NewErrorClassifier(c.Errors)
+	if err != nil {
+		return nil, err
+	}
+
 	return &ApmLogConnector{
-		config:       c,
-		logsConsumer: nextConsumer,
-		logger:       set.Logger,
+		config:          c,
+		logsConsumer:    nextConsumer,
+		namer:           namer,
+		errorClassifier: errorClassifier,
+		logger:          set.Logger,
 	}, nil
 }
 
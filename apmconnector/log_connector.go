@@ -2,6 +2,9 @@ package apmconnector
 
 import (
 	"context"
+	"sync"
+	"time"
+
 	"go.opentelemetry.io/collector/component"
 	"go.opentelemetry.io/collector/consumer"
 	"go.opentelemetry.io/collector/pdata/ptrace"
@@ -12,7 +15,13 @@ type ApmLogConnector struct {
 	config *Config
 	logger *zap.Logger
 
-	logsConsumer consumer.Logs
+	logsConsumer    consumer.Logs
+	namer           *TransactionNamer
+	errorClassifier *ErrorClassifier
+	// nil when the transaction traces are disabled
+	sampler    *TransactionTraceSampler
+	shutdownCh chan struct{}
+	wg         sync.WaitGroup
 }
 
 func (c *ApmLogConnector) Capabilities() consumer.Capabilities {
@@ -20,7 +29,7 @@ func (c *ApmLogConnector) Capabilities() consumer.Capabilities {
 }
 
 func (c *ApmLogConnector) ConsumeTraces(ctx context.Context, td ptrace.Traces) error {
-	logs := BuildTransactions(td)
+	logs := BuildTransactions(c.namer, c.errorClassifier, c.config.ApdexT, c.config.LogsOutput, c.sampler, td)
 	return c.logsConsumer.ConsumeLogs(ctx, logs)
 }
 
@@ -29,10 +38,52 @@ func (c *ApmLogConnector) Start(_ context.Context, host component.Host) error {
 	if c.config.ApdexT == 0 {
 		c.config.ApdexT = 0.5
 	}
+	if c.config.TransactionTraces.Enabled {
+		threshold := c.config.TransactionTraces.Threshold.Seconds()
+		if threshold == 0 {
+			threshold = c.config.ApdexT * 4
+		}
+		c.sampler = NewTransactionTraceSampler(threshold, c.config.TransactionTraces.MaxTraces)
+		c.shutdownCh = make(chan struct{})
+		c.wg.Add(1)
+		go c.run()
+	}
 	return nil
 }
 
-func (c *ApmLogConnector) Shutdown(context.Context) error {
+func (c *ApmLogConnector) Shutdown(ctx context.Context) error {
 	c.logger.Info("Stopping the APM Log Connector")
-	return nil
+	if c.shutdownCh == nil {
+		return nil
+	}
+	close(c.shutdownCh)
+	c.wg.Wait()
+	c.shutdownCh = nil
+	return c.harvestTransactionTraces(ctx)
+}
+
+// run sends the sampled transaction traces at the end of every harvest interval
+func (c *ApmLogConnector) run() {
+	defer c.wg.Done()
+	harvestTicker := time.NewTicker(c.config.TransactionTraces.HarvestInterval)
+	defer harvestTicker.Stop()
+
+	for {
+		select {
+		case <-c.shutdownCh:
+			return
+		case <-harvestTicker.C:
+			if err := c.harvestTransactionTraces(context.Background()); err != nil {
+				c.logger.Error("Failed to export transaction traces", zap.Error(err))
+			}
+		}
+	}
+}
+
+func (c *ApmLogConnector) harvestTransactionTraces(ctx context.Context) error {
+	logs := c.sampler.Harvest()
+	if logs.LogRecordCount() == 0 {
+		return nil
+	}
+	return c.logsConsumer.ConsumeLogs(ctx, logs)
 }
@@ -2,7 +2,9 @@ package apmconnector
 
 import (
 	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/collector/pdata/plog"
 	"go.opentelemetry.io/collector/pdata/ptrace"
+	"strings"
 	"testing"
 	"time"
 )
@@ -20,6 +22,282 @@ func TestConvertOneSpanToLogs(t *testing.T) {
 	spanValues := []TestSpan{{Start: start, End: end, Name: "span", Kind: ptrace.SpanKindServer}}
 	addSpan(scopeSpans, attrs, spanValues)
 
-	logs := BuildTransactions(traces)
+	logs := BuildTransactions(&TransactionNamer{}, nil, 0.5, LogsOutputTransactions, nil, traces)
 	assert.Equal(t, 1, logs.LogRecordCount())
 }
+
+func TestIgnoredTransactionNotConvertedToLogs(t *testing.T) {
+	traces := ptrace.NewTraces()
+	resourceSpans := traces.ResourceSpans().AppendEmpty()
+	resourceSpans.Resource().Attributes().PutStr("service.name", "service")
+	scopeSpans := resourceSpans.ScopeSpans().AppendEmpty().Spans()
+	end := time.Now()
+	start := end.Add(-time.Second)
+	spanValues := []TestSpan{{Start: start, End: end, Name: "span", Kind: ptrace.SpanKindServer}}
+	addSpan(scopeSpans, map[string]string{"url.path": "/health"}, spanValues)
+	addSpan(scopeSpans, map[string]string{"url.path": "/users/12"}, spanValues)
+
+	namer, _ := NewTransactionNamer([]NamingRuleConfig{{Match: `^/health$`, Ignore: true}, {Type: IdSegmentsNamingRule}}, nil)
+	logs := BuildTransactions(namer, nil, 0.5, LogsOutputTransactions, nil, traces)
+	assert.Equal(t, 1, logs.LogRecordCount())
+	name, _ := logs.ResourceLogs().At(0).ScopeLogs().At(0).LogRecords().At(0).Attributes().Get("name")
+	assert.Equal(t, "WebTransaction/Uri/users/*", name.AsString())
+}
+
+func getLogRecords(logs plog.Logs, eventName string) []plog.LogRecord {
+	var records []plog.LogRecord
+	for i := 0; i < logs.ResourceLogs().Len(); i++ {
+		scopeLogs := logs.ResourceLogs().At(i).ScopeLogs()
+		for j := 0; j < scopeLogs.Len(); j++ {
+			for k := 0; k < scopeLogs.At(j).LogRecords().Len(); k++ {
+				record := scopeLogs.At(j).LogRecords().At(k)
+				if name, _ := record.Attributes().Get("event.name"); name.AsString() == eventName {
+					records = append(records, record)
+				}
+			}
+		}
+	}
+	return records
+}
+
+func TestTransactionErrors(t *testing.T) {
+	traces := ptrace.NewTraces()
+	resourceSpans := traces.ResourceSpans().AppendEmpty()
+	resourceSpans.Resource().Attributes().PutStr("host.name", "web-1")
+	spans := resourceSpans.ScopeSpans().AppendEmpty().Spans()
+
+	root := newTimedTestSpan([8]byte{1}, [8]byte{}, ptrace.SpanKindServer, 0, 100)
+	root.Attributes().PutStr("http.route", "/orders")
+	root.Status().SetCode(ptrace.StatusCodeError)
+	root.Status().SetMessage("request failed")
+	root.CopyTo(spans.AppendEmpty())
+
+	child := newTimedTestSpan([8]byte{2}, [8]byte{1}, ptrace.SpanKindInternal, 10, 20)
+	event := child.Events().AppendEmpty()
+	event.SetName("exception")
+	event.Attributes().PutStr("exception.type", "java.lang.IllegalStateException")
+	event.Attributes().PutStr("exception.message", "no stock")
+	event.Attributes().PutStr("exception.stacktrace", strings.Repeat("at Inventory.reserve\n", 500))
+	child.CopyTo(spans.AppendEmpty())
+
+	// no error, no exception
+	newTimedTestSpan([8]byte{3}, [8]byte{1}, ptrace.SpanKindInternal, 20, 30).CopyTo(spans.AppendEmpty())
+
+	logs := BuildTransactions(&TransactionNamer{}, nil, 0.5, LogsOutputTransactions, nil, traces)
+	assert.Equal(t, 1, len(getLogRecords(logs, "Transaction")))
+	errors := getLogRecords(logs, "TransactionError")
+	assert.Equal(t, 2, len(errors))
+
+	expected := []map[string]string{
+		{"error.class": "Error", "error.message": "request failed", "transactionName": "WebTransaction/http.route/orders",
+			"span.id": root.SpanID().String(), "host": "web-1", "event.domain": "newrelic.otel_collector"},
+		{"error.class": "java.lang.IllegalStateException", "error.message": "no stock", "transactionName": "WebTransaction/http.route/orders",
+			"span.id": child.SpanID().String(), "trace.id": child.TraceID().String()},
+	}
+	for i, record := range errors {
+		for key, value := range expected[i] {
+			actual, _ := record.Attributes().Get(key)
+			assert.Equal(t, value, actual.AsString(), key)
+		}
+	}
+	stacktrace, _ := errors[1].Attributes().Get("exception.stacktrace")
+	assert.Equal(t, 4096, len(stacktrace.AsString()))
+}
+
+func TestTransactionErrorNamedAfterRootSpan(t *testing.T) {
+	traces := ptrace.NewTraces()
+	resourceSpans := traces.ResourceSpans().AppendEmpty()
+	root := newTimedTestSpan([8]byte{1}, [8]byte{}, ptrace.SpanKindServer, 0, 100)
+	root.Attributes().PutStr("http.route", "/orders")
+	root.CopyTo(resourceSpans.ScopeSpans().AppendEmpty().Spans().AppendEmpty())
+	// recorded by another instrumentation scope, two levels below the root span
+	spans := resourceSpans.ScopeSpans().AppendEmpty().Spans()
+	newTimedTestSpan([8]byte{2}, [8]byte{1}, ptrace.SpanKindInternal, 10, 50).CopyTo(spans.AppendEmpty())
+	child := newTimedTestSpan([8]byte{3}, [8]byte{2}, ptrace.SpanKindInternal, 20, 30)
+	child.Events().AppendEmpty().SetName("exception")
+	child.CopyTo(spans.AppendEmpty())
+	// the root span of this one is not in the batch
+	orphan := newTimedTestSpan([8]byte{5}, [8]byte{4}, ptrace.SpanKindInternal, 20, 30)
+	orphan.Events().AppendEmpty().SetName("exception")
+	orphan.CopyTo(spans.AppendEmpty())
+
+	errors := getLogRecords(BuildTransactions(&TransactionNamer{}, nil, 0.5, LogsOutputTransactions, nil, traces), "TransactionError")
+	assert.Equal(t, 1, len(errors))
+	transactionName, _ := errors[0].Attributes().Get("transactionName")
+	assert.Equal(t, "WebTransaction/http.route/orders", transactionName.AsString())
+	spanId, _ := errors[0].Attributes().Get("span.id")
+	assert.Equal(t, child.SpanID().String(), spanId.AsString())
+}
+
+func TestTransactionErrorOfIgnoredTransaction(t *testing.T) {
+	traces := ptrace.NewTraces()
+	spans := traces.ResourceSpans().AppendEmpty().ScopeSpans().AppendEmpty().Spans()
+	root := newTimedTestSpan([8]byte{1}, [8]byte{}, ptrace.SpanKindServer, 0, 100)
+	root.Attributes().PutStr("url.path", "/health")
+	root.Events().AppendEmpty().SetName("exception")
+	root.CopyTo(spans.AppendEmpty())
+
+	namer, _ := NewTransactionNamer([]NamingRuleConfig{{Match: `^/health$`, Ignore: true}}, nil)
+	assert.Equal(t, 0, BuildTransactions(namer, nil, 0.5, LogsOutputTransactions, nil, traces).LogRecordCount())
+}
+
+func TestExpectedAndIgnoredTransactionErrors(t *testing.T) {
+	traces := ptrace.NewTraces()
+	spans := traces.ResourceSpans().AppendEmpty().ScopeSpans().AppendEmpty().Spans()
+	root := newTimedTestSpan([8]byte{1}, [8]byte{}, ptrace.SpanKindServer, 0, 100)
+	root.Attributes().PutStr("http.route", "/orders")
+	root.Attributes().PutInt("http.response.status_code", 503)
+	root.CopyTo(spans.AppendEmpty())
+	child := newTimedTestSpan([8]byte{2}, [8]byte{1}, ptrace.SpanKindInternal, 10, 20)
+	event := child.Events().AppendEmpty()
+	event.SetName("exception")
+	event.Attributes().PutStr("exception.type", "CancelledError")
+	child.CopyTo(spans.AppendEmpty())
+
+	classifier, _ := NewErrorClassifier(ErrorRulesConfig{ErrorStatusCodes: []string{"500-599"},
+		ExpectedStatusCodes: []string{"503"}, IgnoreClasses: []string{"CancelledError"}})
+	logs := BuildTransactions(&TransactionNamer{}, classifier, 0.5, LogsOutputTransactions, nil, traces)
+
+	transactions := getLogRecords(logs, "Transaction")
+	assert.Equal(t, 1, len(transactions))
+	err, _ := transactions[0].Attributes().Get("error")
+	assert.False(t, err.Bool())
+	expected, _ := transactions[0].Attributes().Get("error.expected")
+	assert.True(t, expected.Bool())
+
+	errors := getLogRecords(logs, "TransactionError")
+	assert.Equal(t, 1, len(errors))
+	spanId, _ := errors[0].Attributes().Get("span.id")
+	assert.Equal(t, root.SpanID().String(), spanId.AsString())
+	expected, _ = errors[0].Attributes().Get("error.expected")
+	assert.True(t, expected.Bool())
+}
+
+func TestTransactionTotals(t *testing.T) {
+	traces := ptrace.NewTraces()
+	frontend := traces.ResourceSpans().AppendEmpty()
+	frontend.Resource().Attributes().PutStr("service.name", "frontend")
+	call := newTimedTestSpan([8]byte{1}, [8]byte{}, ptrace.SpanKindClient, 0, 1000)
+	call.CopyTo(frontend.ScopeSpans().AppendEmpty().Spans().AppendEmpty())
+
+	backend := traces.ResourceSpans().AppendEmpty()
+	backend.Resource().Attributes().PutStr("service.name", "orders")
+	backend.Resource().Attributes().PutStr("host.name", "web-1")
+	spans := backend.ScopeSpans().AppendEmpty().Spans()
+	root := newTimedTestSpan([8]byte{2}, [8]byte{1}, ptrace.SpanKindServer, 0, 1000)
+	root.Attributes().PutStr("http.route", "/orders")
+	root.Attributes().PutStr("http.request.method", "POST")
+	root.Attributes().PutInt("http.response.status_code", 201)
+	root.CopyTo(spans.AppendEmpty())
+	for i, interval := range [][2]int64{{100, 200}, {150, 350}} {
+		query := newTimedTestSpan([8]byte{byte(3 + i)}, [8]byte{2}, ptrace.SpanKindClient, interval[0], interval[1])
+		query.Attributes().PutStr("db.system", "postgresql")
+		query.Attributes().PutStr("db.statement", "SELECT * FROM orders")
+		query.CopyTo(spans.AppendEmpty())
+	}
+	external := newTimedTestSpan([8]byte{5}, [8]byte{2}, ptrace.SpanKindClient, 400, 900)
+	external.Attributes().PutStr("server.address", "billing")
+	external.CopyTo(spans.AppendEmpty())
+
+	transactions := getLogRecords(BuildTransactions(&TransactionNamer{}, nil, 0.5, LogsOutputTransactions, nil, traces), "Transaction")
+	assert.Equal(t, 1, len(transactions))
+	attributes := transactions[0].Attributes().AsRaw()
+	for key, value := range map[string]any{
+		"name":                 "WebTransaction/http.route/orders (POST)",
+		"host":                 "web-1",
+		"http.statusCode":      int64(201),
+		"request.method":       "POST",
+		"apdexPerfZone":        "S",
+		"databaseCallCount":    int64(2),
+		"databaseDuration":     300e-9,
+		"externalCallCount":    int64(1),
+		"externalDuration":     500e-9,
+		"totalTime":            1050e-9,
+		"parentSpanId":         call.SpanID().String(),
+		"parent.app":           "frontend",
+		"parent.transportType": "HTTP",
+	} {
+		assert.Equal(t, value, attributes[key], key)
+	}
+}
+
+func TestSpanEvents(t *testing.T) {
+	traces := ptrace.NewTraces()
+	spans := traces.ResourceSpans().AppendEmpty().ScopeSpans().AppendEmpty().Spans()
+	root := newTimedTestSpan([8]byte{1}, [8]byte{}, ptrace.SpanKindServer, 0, 1000)
+	root.Attributes().PutStr("http.route", "/orders")
+	root.CopyTo(spans.AppendEmpty())
+	query := newTimedTestSpan([8]byte{2}, [8]byte{1}, ptrace.SpanKindClient, 100, 300)
+	query.Attributes().PutStr("db.system", "postgresql")
+	query.Attributes().PutStr("db.statement", "SELECT * FROM orders")
+	query.CopyTo(spans.AppendEmpty())
+	external := newTimedTestSpan([8]byte{3}, [8]byte{1}, ptrace.SpanKindClient, 400, 900)
+	external.Attributes().PutStr("server.address", "billing")
+	external.CopyTo(spans.AppendEmpty())
+	internal := newTimedTestSpan([8]byte{4}, [8]byte{3}, ptrace.SpanKindInternal, 500, 600)
+	internal.CopyTo(spans.AppendEmpty())
+
+	logs := BuildTransactions(&TransactionNamer{}, nil, 0.5, LogsOutputSpans, nil, traces)
+	assert.Equal(t, 0, len(getLogRecords(logs, "Transaction")))
+	events := getLogRecords(logs, "Span")
+	assert.Equal(t, 4, len(events))
+
+	expected := []map[string]any{
+		{"nr.entryPoint": true, "category": "generic", "duration": 1000e-9},
+		{"nr.entryPoint": false, "category": "datastore", "parentId": root.SpanID().String(), "db.sql.table": "orders", "duration": 200e-9},
+		{"nr.entryPoint": false, "category": "http", "parentId": root.SpanID().String(), "external.host": "billing"},
+		{"nr.entryPoint": false, "category": "generic", "parentId": external.SpanID().String()},
+	}
+	for i, event := range events {
+		attributes := event.Attributes().AsRaw()
+		assert.Equal(t, root.SpanID().String(), attributes["transactionId"])
+		assert.Equal(t, "WebTransaction/http.route/orders", attributes["transactionName"])
+		for key, value := range expected[i] {
+			assert.Equal(t, value, attributes[key], key)
+		}
+	}
+	_, hasParent := events[0].Attributes().Get("parentId")
+	assert.False(t, hasParent)
+
+	logs = BuildTransactions(&TransactionNamer{}, nil, 0.5, LogsOutputAll, nil, traces)
+	assert.Equal(t, 1, len(getLogRecords(logs, "Transaction")))
+	assert.Equal(t, 4, len(getLogRecords(logs, "Span")))
+}
+
+func TestSpanEventsWithoutRootSpan(t *testing.T) {
+	traces := ptrace.NewTraces()
+	spans := traces.ResourceSpans().AppendEmpty().ScopeSpans().AppendEmpty().Spans()
+	// the server span with id 1 is in another batch
+	client := newTimedTestSpan([8]byte{2}, [8]byte{1}, ptrace.SpanKindClient, 100, 300)
+	client.Attributes().PutStr("server.address", "billing")
+	client.CopyTo(spans.AppendEmpty())
+	internal := newTimedTestSpan([8]byte{3}, [8]byte{2}, ptrace.SpanKindInternal, 150, 250)
+	internal.CopyTo(spans.AppendEmpty())
+
+	events := getLogRecords(BuildTransactions(&TransactionNamer{}, nil, 0.5, LogsOutputSpans, nil, traces), "Span")
+	assert.Equal(t, 2, len(events))
+	for _, event := range events {
+		attributes := event.Attributes().AsRaw()
+		assert.Equal(t, false, attributes["nr.entryPoint"])
+		_, hasTransactionId := attributes["transactionId"]
+		assert.False(t, hasTransactionId)
+		_, hasTransactionName := attributes["transactionName"]
+		assert.False(t, hasTransactionName)
+	}
+}
+
+func TestNestedMessageConsumerIsNotATransaction(t *testing.T) {
+	traces := ptrace.NewTraces()
+	spans := traces.ResourceSpans().AppendEmpty().ScopeSpans().AppendEmpty().Spans()
+	root := newTimedTestSpan([8]byte{1}, [8]byte{}, ptrace.SpanKindServer, 0, 100)
+	root.Attributes().PutStr("http.route", "/jobs")
+	root.CopyTo(spans.AppendEmpty())
+	consumer := newTimedTestSpan([8]byte{2}, [8]byte{1}, ptrace.SpanKindConsumer, 10, 60)
+	consumer.Attributes().PutStr("messaging.system", "kafka")
+	consumer.CopyTo(spans.AppendEmpty())
+
+	transactions := getLogRecords(BuildTransactions(&TransactionNamer{}, nil, 0.5, LogsOutputTransactions, nil, traces), "Transaction")
+	assert.Equal(t, 1, len(transactions))
+	name, _ := transactions[0].Attributes().Get("name")
+	assert.Equal(t, "WebTransaction/http.route/jobs", name.AsString())
+}
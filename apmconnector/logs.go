@@ -1,43 +1,313 @@
 package apmconnector
 
 import (
+	"strconv"
+	"strings"
+
+	"go.opentelemetry.io/collector/pdata/pcommon"
 	"go.opentelemetry.io/collector/pdata/plog"
 	"go.opentelemetry.io/collector/pdata/ptrace"
 )
 
-func BuildTransactions(td ptrace.Traces) plog.Logs {
+const (
+	ExceptionEventName               = "exception"
+	ExceptionTypeAttributeName       = "exception.type"
+	ExceptionMessageAttributeName    = "exception.message"
+	ExceptionStacktraceAttributeName = "exception.stacktrace"
+	maxStacktraceLength              = 4096
+)
+
+type LogsOutputMode string
+
+const (
+	// LogsOutputTransactions emits the Transaction and TransactionError events
+	LogsOutputTransactions LogsOutputMode = "transactions"
+	// LogsOutputSpans emits a Span event per span
+	LogsOutputSpans LogsOutputMode = "spans"
+	// LogsOutputAll emits the events of both modes
+	LogsOutputAll LogsOutputMode = "all"
+)
+
+func (mode LogsOutputMode) hasTransactions() bool {
+	return mode == "" || mode == LogsOutputTransactions || mode == LogsOutputAll
+}
+
+func (mode LogsOutputMode) hasSpans() bool {
+	return mode == LogsOutputSpans || mode == LogsOutputAll
+}
+
+// BuildTransactions builds the Transaction and TransactionError events, or the Span events, of the
+// spans. The spans are grouped in transactions like in the metrics connector, so that the
+// Transaction events have the totals of their database and external calls. The error classifier
+// can be nil when only the span status is used. The transactions are offered to the sampler of
+// transaction traces, which can be nil too.
+func BuildTransactions(namer *TransactionNamer, errorClassifier *ErrorClassifier, apdexT float64, output LogsOutputMode,
+	sampler *TransactionTraceSampler, td ptrace.Traces) plog.Logs {
 	logs := plog.NewLogs()
+	// nothing is recorded, the resource metrics only tell the services apart
+	meterProvider := NewMeterProvider(MetricsConfig{})
+	transactions := NewTransactionsMap(apdexT, namer, nil, errorClassifier)
+	resourceMetricsBySpans := make([]*ResourceMetrics, td.ResourceSpans().Len())
+	// service of every span of the batch, to find the callers of the transactions
+	services := make(map[string]string)
+	for i := 0; i < td.ResourceSpans().Len(); i++ {
+		rs := td.ResourceSpans().At(i)
+		resourceMetrics := meterProvider.getOrCreateResourceMetrics(rs.Resource().Attributes())
+		resourceMetricsBySpans[i] = resourceMetrics
+		for j := 0; j < rs.ScopeSpans().Len(); j++ {
+			scopeSpan := rs.ScopeSpans().At(j)
+			for k := 0; k < scopeSpan.Spans().Len(); k++ {
+				span := scopeSpan.Spans().At(k)
+				transactions.IndexSpan(span, resourceMetrics)
+				services[span.TraceID().String()+span.SpanID().String()] = resourceMetrics.serviceName
+			}
+		}
+	}
+	for i := 0; i < td.ResourceSpans().Len(); i++ {
+		rs := td.ResourceSpans().At(i)
+		sdkLanguage := GetSdkLanguage(rs.Resource().Attributes())
+		for j := 0; j < rs.ScopeSpans().Len(); j++ {
+			scopeSpan := rs.ScopeSpans().At(j)
+			for k := 0; k < scopeSpan.Spans().Len(); k++ {
+				span := scopeSpan.Spans().At(k)
+				transaction, _ := transactions.GetOrCreateTransaction(sdkLanguage, span, resourceMetricsBySpans[i])
+				transaction.AddSpan(span, scopeSpan.Scope())
+			}
+		}
+	}
+
+	// the name of a transaction is copied to all its Span events
+	transactionNames := make(map[*Transaction]string)
 	for i := 0; i < td.ResourceSpans().Len(); i++ {
 		resourceLogs := logs.ResourceLogs().AppendEmpty()
 		rs := td.ResourceSpans().At(i)
 		rs.Resource().CopyTo(resourceLogs.Resource())
+		resourceMetrics := resourceMetricsBySpans[i]
+		sdkLanguage := GetSdkLanguage(rs.Resource().Attributes())
+
 		for j := 0; j < rs.ScopeSpans().Len(); j++ {
 			scopeSpan := rs.ScopeSpans().At(j)
 			scopeLog := resourceLogs.ScopeLogs().AppendEmpty()
 			for k := 0; k < scopeSpan.Spans().Len(); k++ {
 				span := scopeSpan.Spans().At(k)
-				if span.Kind() != ptrace.SpanKindServer {
+				transaction, _ := transactions.GetOrCreateTransaction(sdkLanguage, span, resourceMetrics)
+				isEntrySpan := transaction.IsRootSet() && transaction.RootSpan.SpanID() == span.SpanID()
+				if output.hasSpans() {
+					transactionName, named := transactionNames[transaction]
+					if !named && transaction.IsRootSet() {
+						transactionName, _ = namer.GetTransactionMetricName(transaction.RootSpan, transaction.RootScope)
+						transactionNames[transaction] = transactionName
+					}
+					log := scopeLog.LogRecords().AppendEmpty()
+					buildSpanEvent(log, transaction, span, transactionName)
+				}
+
+				transactionName, transactionType := namer.GetTransactionMetricName(span, scopeSpan.Scope())
+				if isEntrySpan && transactionType != NullTransactionType {
+					sampler.Offer(transaction, transactionName, transactionType, rs.Resource())
+				}
+				if !output.hasTransactions() {
+					continue
+				}
+
+				errorClassification := NotAnError
+				// a consumer nested in a transaction of the service is not a transaction of its own
+				if transactionType != NullTransactionType && !isEntrySpan && IsMessageConsumerSpan(span) {
+					transactionType = NullTransactionType
+				}
+				if transactionType != NullTransactionType {
+					errorClassification = errorClassifier.Classify(span)
+					log := scopeLog.LogRecords().AppendEmpty()
+					buildTransaction(log, transaction, span, transactionName, transactionType, errorClassification, resourceMetrics.hostName)
+					if isEntrySpan {
+						addTransactionCaller(log, span, services)
+					}
+				}
+
+				exception, hasException := getLastException(span)
+				if hasException {
+					errorClassification = errorClassifier.ClassifyException(span)
+				}
+				if errorClassification == NotAnError {
 					continue
 				}
+				if hasException {
+					// the exception is reported in the transaction of the span, named after its root span
+					if !transaction.IsRootSet() {
+						continue
+					}
+					transactionName, transactionType = namer.GetTransactionMetricName(transaction.RootSpan, transaction.RootScope)
+					if transactionType == NullTransactionType {
+						continue
+					}
+				}
 				log := scopeLog.LogRecords().AppendEmpty()
-				buildTransaction(log, span)
+				buildTransactionError(log, span, exception, transactionName, resourceMetrics.hostName, errorClassification == ExpectedError)
 			}
 		}
 	}
 	return logs
 }
 
-func buildTransaction(lr plog.LogRecord, span ptrace.Span) {
+// getLastException returns the attributes of the last exception event of a span
+func getLastException(span ptrace.Span) (pcommon.Map, bool) {
+	for i := span.Events().Len() - 1; i >= 0; i-- {
+		if event := span.Events().At(i); event.Name() == ExceptionEventName {
+			return event.Attributes(), true
+		}
+	}
+	return pcommon.NewMap(), false
+}
+
+// buildTransaction describes a transaction. The durations and counts of the calls are the ones of
+// the transaction only when span is its entry span, not when it is a span named by a rule.
+func buildTransaction(lr plog.LogRecord, transaction *Transaction, span ptrace.Span, transactionName string, transactionType TransactionType,
+	errorClassification ErrorClassification, hostName string) {
 	lr.Attributes().PutStr("event.domain", "newrelic.otel_collector")
 	lr.Attributes().PutStr("event.name", "Transaction")
 
-	transactionName, transactionType := GetTransactionMetricName(span)
 	lr.Attributes().PutStr("transactionType", transactionType.AsString())
 	lr.Attributes().PutStr("name", transactionName)
 
 	lr.Attributes().PutStr("trace.id", span.TraceID().String())
-	duration := float64((span.EndTimestamp() - span.StartTimestamp()).AsTime().UnixNano()) / 1e9
+	duration := NanosToSeconds(DurationInNanos(span))
 	lr.Attributes().PutDouble("duration", duration)
-	err := span.Status().Code() == ptrace.StatusCodeError
-	lr.Attributes().PutBool("error", err)
+	lr.Attributes().PutBool("error", errorClassification == UnexpectedError)
+	if errorClassification == ExpectedError {
+		lr.Attributes().PutBool("error.expected", true)
+	}
+	if hostName != "" {
+		lr.Attributes().PutStr("host", hostName)
+	}
+	if statusCode, exists := GetHttpStatusCode(span); exists {
+		lr.Attributes().PutInt("http.statusCode", statusCode)
+	}
+	if method, exists := HttpRequestMethodAttribute.Get(span.Attributes()); exists {
+		lr.Attributes().PutStr("request.method", method.AsString())
+	}
+	if transactionType == WebTransactionType {
+		apdexPerfZone := "F"
+		if errorClassification != UnexpectedError {
+			apdexPerfZone = transaction.apdex.GetApdexBucket(duration)
+		}
+		lr.Attributes().PutStr("apdexPerfZone", apdexPerfZone)
+	}
+
+	if !transaction.IsRootSet() || transaction.RootSpan.SpanID() != span.SpanID() {
+		return
+	}
+	totals := transaction.GetTotals()
+	lr.Attributes().PutDouble("totalTime", NanosToSeconds(totals.TotalTimeNanos))
+	if totals.DatabaseCallCount > 0 {
+		lr.Attributes().PutDouble("databaseDuration", NanosToSeconds(totals.DatabaseDurationNanos))
+		lr.Attributes().PutInt("databaseCallCount", int64(totals.DatabaseCallCount))
+	}
+	if totals.ExternalCallCount > 0 {
+		lr.Attributes().PutDouble("externalDuration", NanosToSeconds(totals.ExternalDurationNanos))
+		lr.Attributes().PutInt("externalCallCount", int64(totals.ExternalCallCount))
+	}
+}
+
+// buildSpanEvent describes a span of a transaction with the New Relic span attributes. The
+// transaction id is the id of the root span of the transaction. It is missing, like the name,
+// when the root span is not in the batch.
+func buildSpanEvent(lr plog.LogRecord, transaction *Transaction, span ptrace.Span, transactionName string) {
+	lr.SetTimestamp(span.StartTimestamp())
+	lr.Attributes().PutStr("event.domain", "newrelic.otel_collector")
+	lr.Attributes().PutStr("event.name", "Span")
+
+	lr.Attributes().PutStr("name", span.Name())
+	lr.Attributes().PutStr("trace.id", span.TraceID().String())
+	lr.Attributes().PutStr("id", span.SpanID().String())
+	if !span.ParentSpanID().IsEmpty() {
+		lr.Attributes().PutStr("parentId", span.ParentSpanID().String())
+	}
+	isEntryPoint := false
+	if transaction.IsRootSet() {
+		lr.Attributes().PutStr("transactionId", transaction.RootSpan.SpanID().String())
+		isEntryPoint = transaction.RootSpan.SpanID() == span.SpanID()
+	}
+	lr.Attributes().PutBool("nr.entryPoint", isEntryPoint)
+	lr.Attributes().PutDouble("duration", NanosToSeconds(DurationInNanos(span)))
+	if transactionName != "" {
+		lr.Attributes().PutStr("transactionName", transactionName)
+	}
+
+	category := GenericSpanCategory
+	if measurement, measured := transaction.Measurements[span.SpanID().String()]; measured {
+		category = measurement.Category
+		for _, key := range []string{DbSystemAttributeName, DbOperationAttributeName, DbSqlTableAttributeName, "external.host", "http.method"} {
+			if value, exists := measurement.Attributes.Get(key); exists {
+				lr.Attributes().PutStr(key, value.AsString())
+			}
+		}
+	}
+	lr.Attributes().PutStr("category", string(category))
+}
+
+// addTransactionCaller describes the caller of a transaction whose entry span has a remote parent.
+// The calling service is only known when its span is in the batch.
+func addTransactionCaller(lr plog.LogRecord, span ptrace.Span, services map[string]string) {
+	if span.ParentSpanID().IsEmpty() {
+		return
+	}
+	lr.Attributes().PutStr("parentSpanId", span.ParentSpanID().String())
+	lr.Attributes().PutStr("parent.transportType", getTransportType(span))
+	if caller := services[span.TraceID().String()+span.ParentSpanID().String()]; caller != "" {
+		lr.Attributes().PutStr("parent.app", caller)
+	}
+}
+
+// getTransportType returns how a transaction was called: HTTP, or the messaging or RPC system
+func getTransportType(span ptrace.Span) string {
+	if messagingSystem, exists := span.Attributes().Get(MessagingSystemAttributeName); exists && IsMessageConsumerSpan(span) {
+		return messagingSystem.AsString()
+	}
+	if rpcSystem, exists := span.Attributes().Get(RpcSystemAttributeName); exists {
+		return rpcSystem.AsString()
+	}
+	if _, exists := HttpRequestMethodAttribute.Get(span.Attributes()); exists {
+		return "HTTP"
+	}
+	return "Unknown"
+}
+
+// buildTransactionError describes an error of a transaction, from the exception event of the span
+// when there is one, or else from the span status
+func buildTransactionError(lr plog.LogRecord, span ptrace.Span, exception pcommon.Map, transactionName string, hostName string, expected bool) {
+	lr.SetTimestamp(span.EndTimestamp())
+	lr.Attributes().PutStr("event.domain", "newrelic.otel_collector")
+	lr.Attributes().PutStr("event.name", "TransactionError")
+
+	errorClass, errorMessage := "Error", span.Status().Message()
+	if statusCode, exists := GetHttpStatusCode(span); exists {
+		errorClass = strconv.FormatInt(statusCode, 10)
+	}
+	if exceptionType, exists := exception.Get(ExceptionTypeAttributeName); exists {
+		errorClass = exceptionType.AsString()
+	}
+	if exceptionMessage, exists := exception.Get(ExceptionMessageAttributeName); exists {
+		errorMessage = exceptionMessage.AsString()
+	}
+	lr.Attributes().PutStr("error.class", errorClass)
+	lr.Attributes().PutStr("error.message", errorMessage)
+	lr.Attributes().PutBool("error.expected", expected)
+	if stacktrace, exists := exception.Get(ExceptionStacktraceAttributeName); exists {
+		lr.Attributes().PutStr(ExceptionStacktraceAttributeName, truncateString(stacktrace.AsString(), maxStacktraceLength))
+	}
+
+	lr.Attributes().PutStr("transactionName", transactionName)
+	lr.Attributes().PutStr("trace.id", span.TraceID().String())
+	lr.Attributes().PutStr("span.id", span.SpanID().String())
+	if hostName != "" {
+		lr.Attributes().PutStr("host", hostName)
+	}
+}
+
+// truncateString cuts s to at most maxLength bytes, without splitting a character
+func truncateString(s string, maxLength int) string {
+	if len(s) <= maxLength {
+		return s
+	}
+	return strings.ToValidUTF8(s[:maxLength], "")
 }
@@ -0,0 +1,102 @@
+package apmconnector
+
+import (
+	"fmt"
+	"strings"
+
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+)
+
+const (
+	MessagingSystemAttributeName          = "messaging.system"
+	MessagingDestinationNameAttributeName = "messaging.destination.name"
+	MessagingDestinationKindAttributeName = "messaging.destination.kind"
+)
+
+var messagingSystemLabels = map[string]string{
+	"activemq":        "ActiveMQ",
+	"aws_sns":         "SNS",
+	"aws_sqs":         "SQS",
+	"azure_eventgrid": "EventGrid",
+	"eventhubs":       "EventHubs",
+	"gcp_pubsub":      "PubSub",
+	"jms":             "JMS",
+	"kafka":           "Kafka",
+	"pulsar":          "Pulsar",
+	"rabbitmq":        "RabbitMQ",
+	"rocketmq":        "RocketMQ",
+	"servicebus":      "ServiceBus",
+}
+
+// systems whose destinations are topics when messaging.destination.kind is not set
+var topicMessagingSystems = map[string]bool{
+	"aws_sns":    true,
+	"eventhubs":  true,
+	"gcp_pubsub": true,
+	"kafka":      true,
+	"pulsar":     true,
+	"rocketmq":   true,
+}
+
+func GetMessagingSystemLabel(messagingSystem string) string {
+	if label, exists := messagingSystemLabels[messagingSystem]; exists {
+		return label
+	}
+	return messagingSystem
+}
+
+// IsMessageConsumerSpan returns true for the consumer spans that process messages
+func IsMessageConsumerSpan(span ptrace.Span) bool {
+	if span.Kind() != ptrace.SpanKindConsumer {
+		return false
+	}
+	_, messagingSystemPresent := span.Attributes().Get(MessagingSystemAttributeName)
+	return messagingSystemPresent
+}
+
+// GetMessagingDestination returns the kind of destination (Queue or Topic) and its name
+func GetMessagingDestination(span ptrace.Span, messagingSystem string) (string, string) {
+	kind := "Queue"
+	if destinationKind, exists := MessagingDestinationKindAttribute.Get(span.Attributes()); exists {
+		if strings.EqualFold(destinationKind.AsString(), "topic") {
+			kind = "Topic"
+		}
+	} else if topicMessagingSystems[messagingSystem] {
+		kind = "Topic"
+	}
+
+	name := "unknown"
+	if destinationName, exists := MessagingDestinationNameAttribute.Get(span.Attributes()); exists {
+		name = destinationName.AsString()
+	}
+	return kind, name
+}
+
+func GetMessageTransactionMetricName(span ptrace.Span) (string, TransactionType) {
+	messagingSystem, _ := span.Attributes().Get(MessagingSystemAttributeName)
+	kind, name := GetMessagingDestination(span, messagingSystem.AsString())
+	return fmt.Sprintf("OtherTransaction/Message/%s/%s/Named/%s", GetMessagingSystemLabel(messagingSystem.AsString()), kind, name), OtherTransactionType
+}
+
+// ProcessProducerSpan records a message sent to a broker
+func (transaction *Transaction) ProcessProducerSpan(span ptrace.Span) bool {
+	messagingSystem, messagingSystemPresent := span.Attributes().Get(MessagingSystemAttributeName)
+	if !messagingSystemPresent {
+		return false
+	}
+	kind, destination := GetMessagingDestination(span, messagingSystem.AsString())
+
+	attributes := pcommon.NewMap()
+	attributes.PutStr(MessagingSystemAttributeName, messagingSystem.AsString())
+	attributes.PutStr(MessagingDestinationNameAttributeName, destination)
+	attributes.PutStr(MessagingDestinationKindAttributeName, kind)
+
+	timesliceName := fmt.Sprintf("MessageBroker/%s/%s/Produce/Named/%s", GetMessagingSystemLabel(messagingSystem.AsString()), kind, destination)
+	measurement := Measurement{SpanId: span.SpanID().String(), MetricName: "apm.service.messagebroker.produce.duration", Span: span,
+		DurationNanos: DurationInNanos(span), Attributes: attributes, SegmentNameProvider: NewSimpleNameProvider("Message broker"),
+		MetricTimesliceName: timesliceName, Category: GenericSpanCategory}
+
+	transaction.AddMeasurement(&measurement)
+	return true
+}
@@ -0,0 +1,157 @@
+package apmconnector
+
+import (
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+	"testing"
+)
+
+func TestGetTransactionMetricNameKafkaConsumer(t *testing.T) {
+	span := ptrace.NewSpan()
+	span.SetKind(ptrace.SpanKindConsumer)
+	span.Attributes().PutStr("messaging.system", "kafka")
+	span.Attributes().PutStr("messaging.destination.name", "orders")
+
+	name, txType := GetTransactionMetricName(span)
+	assert.Equal(t, "OtherTransaction/Message/Kafka/Topic/Named/orders", name)
+	assert.Equal(t, OtherTransactionType, txType)
+}
+
+func TestGetTransactionMetricNameQueueConsumer(t *testing.T) {
+	span := ptrace.NewSpan()
+	span.SetKind(ptrace.SpanKindConsumer)
+	span.Attributes().PutStr("messaging.system", "rabbitmq")
+	span.Attributes().PutStr("messaging.destination.name", "emails")
+
+	name, _ := GetTransactionMetricName(span)
+	assert.Equal(t, "OtherTransaction/Message/RabbitMQ/Queue/Named/emails", name)
+
+	span.Attributes().PutStr("messaging.destination.kind", "topic")
+	name, _ = GetTransactionMetricName(span)
+	assert.Equal(t, "OtherTransaction/Message/RabbitMQ/Topic/Named/emails", name)
+}
+
+func TestGetTransactionMetricNameConsumerWithoutSystem(t *testing.T) {
+	span := ptrace.NewSpan()
+	span.SetKind(ptrace.SpanKindConsumer)
+
+	_, txType := GetTransactionMetricName(span)
+	assert.Equal(t, NullTransactionType, txType)
+}
+
+func TestMessageConsumerTransaction(t *testing.T) {
+	transactions := NewTransactionsMap(0.5, &TransactionNamer{}, nil, nil)
+	metrics := NewMeterProvider(MetricsConfig{}).getOrCreateResourceMetrics(pcommon.NewMap())
+
+	// the producer lives in another service, the consumer span still has a parent
+	consumer := newTimedTestSpan([8]byte{1}, [8]byte{9}, ptrace.SpanKindConsumer, 0, 100)
+	consumer.Attributes().PutStr("messaging.system", "aws_sqs")
+	consumer.Attributes().PutStr("messaging.destination.name", "jobs")
+	consumer.Status().SetCode(ptrace.StatusCodeError)
+	db := newTimedTestSpan([8]byte{2}, [8]byte{1}, ptrace.SpanKindClient, 10, 70)
+	db.Attributes().PutStr(DbSystemAttributeName, "mysql")
+	db.Attributes().PutStr(DbOperationAttributeName, "INSERT")
+
+	for _, span := range []ptrace.Span{db, consumer} {
+		transactions.IndexSpan(span, metrics)
+	}
+	for _, span := range []ptrace.Span{db, consumer} {
+		transaction, _ := transactions.GetOrCreateTransaction("java", span, metrics)
+		transaction.AddSpan(span, pcommon.NewInstrumentationScope())
+	}
+	assert.Equal(t, 1, len(transactions.Transactions))
+	transactions.ProcessTransactions()
+
+	duration := metrics.nameToMetric["apm.service.transaction.duration"].Histogram().DataPoints()
+	assert.Equal(t, 1, duration.Len())
+	name, _ := duration.At(0).Attributes().Get("transactionName")
+	assert.Equal(t, "OtherTransaction/Message/SQS/Queue/Named/jobs", name.AsString())
+	txType, _ := duration.At(0).Attributes().Get("transactionType")
+	assert.Equal(t, "Other", txType.AsString())
+
+	breakdown := make(map[string]float64)
+	overview := metrics.nameToMetric["apm.service.overview.other"].Histogram().DataPoints()
+	for i := 0; i < overview.Len(); i++ {
+		segment, _ := overview.At(i).Attributes().Get("segmentName")
+		breakdown[segment.AsString()] += overview.At(i).Sum()
+	}
+	assert.Equal(t, map[string]float64{"java": 40e-9, "mysql": 60e-9}, breakdown)
+
+	assert.Equal(t, 1, metrics.nameToMetric["apm.service.error.count"].Sum().DataPoints().Len())
+	_, apdexPresent := metrics.nameToMetric["apm.service.apdex"]
+	assert.False(t, apdexPresent)
+}
+
+func TestProducerSpanMeasurement(t *testing.T) {
+	transactions := NewTransactionsMap(0.5, &TransactionNamer{}, nil, nil)
+	metrics := NewMeterProvider(MetricsConfig{}).getOrCreateResourceMetrics(pcommon.NewMap())
+
+	root := newTimedTestSpan([8]byte{1}, [8]byte{}, ptrace.SpanKindServer, 0, 100)
+	root.Attributes().PutStr("http.route", "/orders")
+	producer := newTimedTestSpan([8]byte{2}, [8]byte{1}, ptrace.SpanKindProducer, 10, 30)
+	producer.Attributes().PutStr("messaging.system", "kafka")
+	producer.Attributes().PutStr("messaging.destination.name", "orders")
+	// a producer span without messaging attributes stays generic
+	other := newTimedTestSpan([8]byte{3}, [8]byte{1}, ptrace.SpanKindProducer, 40, 50)
+	other.SetName("publish")
+
+	spans := []ptrace.Span{root, producer, other}
+	for _, span := range spans {
+		transactions.IndexSpan(span, metrics)
+	}
+	for _, span := range spans {
+		transaction, _ := transactions.GetOrCreateTransaction("java", span, metrics)
+		transaction.AddSpan(span, pcommon.NewInstrumentationScope())
+	}
+	transactions.ProcessTransactions()
+
+	for _, transaction := range transactions.Transactions {
+		measurement := transaction.Measurements[producer.SpanID().String()]
+		assert.Equal(t, "MessageBroker/Kafka/Topic/Produce/Named/orders", measurement.MetricTimesliceName)
+		assert.Equal(t, "apm.service.messagebroker.produce.duration", measurement.MetricName)
+		destination, _ := measurement.Attributes.Get("messaging.destination.name")
+		assert.Equal(t, "orders", destination.AsString())
+		assert.Equal(t, "Custom/publish", transaction.Measurements[other.SpanID().String()].MetricTimesliceName)
+	}
+
+	assert.Equal(t, 1, metrics.nameToMetric["apm.service.messagebroker.produce.duration"].Histogram().DataPoints().Len())
+	breakdown := make(map[string]float64)
+	overview := metrics.nameToMetric["apm.service.overview.web"].Histogram().DataPoints()
+	for i := 0; i < overview.Len(); i++ {
+		segment, _ := overview.At(i).Attributes().Get("segmentName")
+		breakdown[segment.AsString()] += overview.At(i).Sum()
+	}
+	assert.Equal(t, map[string]float64{"java": 80e-9, "Message broker": 20e-9}, breakdown)
+}
+
+func TestNestedMessageConsumerSpan(t *testing.T) {
+	transactions := NewTransactionsMap(0.5, &TransactionNamer{}, nil, nil)
+	metrics := NewMeterProvider(MetricsConfig{}).getOrCreateResourceMetrics(pcommon.NewMap())
+
+	// a consumer span processing a message within a request of the same service
+	root := newTimedTestSpan([8]byte{1}, [8]byte{}, ptrace.SpanKindServer, 0, 100)
+	root.Attributes().PutStr("http.route", "/jobs")
+	consumer := newTimedTestSpan([8]byte{2}, [8]byte{1}, ptrace.SpanKindConsumer, 10, 60)
+	consumer.Attributes().PutStr("messaging.system", "aws_sqs")
+	consumer.Attributes().PutStr("messaging.destination.name", "jobs")
+	db := newTimedTestSpan([8]byte{3}, [8]byte{2}, ptrace.SpanKindClient, 20, 40)
+	db.Attributes().PutStr(DbSystemAttributeName, "mysql")
+	db.Attributes().PutStr(DbOperationAttributeName, "INSERT")
+
+	spans := []ptrace.Span{db, consumer, root}
+	for _, span := range spans {
+		transactions.IndexSpan(span, metrics)
+	}
+	for _, span := range spans {
+		transaction, _ := transactions.GetOrCreateTransaction("java", span, metrics)
+		transaction.AddSpan(span, pcommon.NewInstrumentationScope())
+	}
+	assert.Equal(t, 1, len(transactions.Transactions))
+	transactions.ProcessTransactions()
+
+	duration := metrics.nameToMetric["apm.service.transaction.duration"].Histogram().DataPoints()
+	assert.Equal(t, 1, duration.Len())
+	name, _ := duration.At(0).Attributes().Get("transactionName")
+	assert.Equal(t, "WebTransaction/http.route/jobs", name.AsString())
+}
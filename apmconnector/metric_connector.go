@@ -2,6 +2,9 @@ package apmconnector
 
 import (
 	"context"
+	"errors"
+	"sync"
+	"time"
 
 	"go.opentelemetry.io/collector/component"
 	"go.opentelemetry.io/collector/consumer"
@@ -15,14 +18,66 @@ type ApmMetricConnector struct {
 	logger *zap.Logger
 
 	metricsConsumer consumer.Metrics
+
+	// guards metricsBuilder, which is shared by the batches until it is flushed
+	mu             sync.Mutex
+	metricsBuilder *MetricsBuilder
+	traceBuffer    *TraceBuffer
+	shutdownCh     chan struct{}
+	wg             sync.WaitGroup
+	// held for reading by the batches being consumed, so that Shutdown waits for them
+	// before the last flush
+	stateMu sync.RWMutex
+	stopped bool
 }
 
+var errConnectorStopped = errors.New("the APM metric connector is shut down")
+
 func (c *ApmMetricConnector) Capabilities() consumer.Capabilities {
 	return consumer.Capabilities{MutatesData: false}
 }
 
 func (c *ApmMetricConnector) ConsumeTraces(ctx context.Context, td ptrace.Traces) error {
-	metrics := ConvertTraces(c.logger, c.config, td)
+	c.stateMu.RLock()
+	defer c.stateMu.RUnlock()
+	// nothing would send the buffered traces or the aggregated metrics anymore
+	if c.stopped {
+		return errConnectorStopped
+	}
+	if c.traceBuffer != nil {
+		td = c.traceBuffer.Add(td, time.Now())
+	}
+	return c.exportTraces(ctx, td)
+}
+
+// exportTraces records the metrics of td, and sends them right away unless they are
+// aggregated over a flush interval
+func (c *ApmMetricConnector) exportTraces(ctx context.Context, td ptrace.Traces) error {
+	if td.SpanCount() == 0 {
+		return nil
+	}
+	c.mu.Lock()
+	c.metricsBuilder.RecordTraces(td)
+	if c.config.Metrics.FlushInterval > 0 {
+		c.mu.Unlock()
+		return nil
+	}
+	metrics := c.metricsBuilder.Flush()
+	c.mu.Unlock()
+	return c.exportMetrics(ctx, metrics)
+}
+
+func (c *ApmMetricConnector) flushMetrics(ctx context.Context) error {
+	c.mu.Lock()
+	metrics := c.metricsBuilder.Flush()
+	c.mu.Unlock()
+	return c.exportMetrics(ctx, metrics)
+}
+
+func (c *ApmMetricConnector) exportMetrics(ctx context.Context, metrics pmetric.Metrics) error {
+	if metrics.MetricCount() == 0 {
+		return nil
+	}
 	err := c.metricsConsumer.ConsumeMetrics(ctx, metrics)
 	if err != nil {
 		return err
@@ -35,19 +90,124 @@ func (c *ApmMetricConnector) Start(_ context.Context, host component.Host) error
 	if c.config.ApdexT == 0 {
 		c.config.ApdexT = 0.5
 	}
+	if c.config.TraceBuffer.DecisionWait > 0 {
+		c.traceBuffer = NewTraceBuffer(c.config.TraceBuffer, c.logger)
+	}
+	if c.traceBuffer != nil || c.config.Metrics.FlushInterval > 0 {
+		c.shutdownCh = make(chan struct{})
+		c.wg.Add(1)
+		go c.run()
+	}
 	return nil
 }
 
-func (c *ApmMetricConnector) Shutdown(context.Context) error {
+func (c *ApmMetricConnector) Shutdown(ctx context.Context) error {
 	c.logger.Info("Stopping the APM Metric Connector")
-	return nil
+	c.stateMu.Lock()
+	stopped := c.stopped
+	c.stopped = true
+	c.stateMu.Unlock()
+	if stopped || c.shutdownCh == nil {
+		return nil
+	}
+	close(c.shutdownCh)
+	c.wg.Wait()
+	if c.traceBuffer != nil {
+		if err := c.exportTraces(ctx, c.traceBuffer.Flush()); err != nil {
+			return err
+		}
+	}
+	return c.flushMetrics(ctx)
 }
 
+// run periodically converts the traces whose decision window has elapsed, and
+// sends the aggregated metrics at the end of every flush interval
+func (c *ApmMetricConnector) run() {
+	defer c.wg.Done()
+
+	var releaseCh, flushCh <-chan time.Time
+	if c.traceBuffer != nil {
+		tick := time.Second
+		if c.config.TraceBuffer.DecisionWait < tick {
+			tick = c.config.TraceBuffer.DecisionWait
+		}
+		releaseTicker := time.NewTicker(tick)
+		defer releaseTicker.Stop()
+		releaseCh = releaseTicker.C
+	}
+	if c.config.Metrics.FlushInterval > 0 {
+		flushTicker := time.NewTicker(c.config.Metrics.FlushInterval)
+		defer flushTicker.Stop()
+		flushCh = flushTicker.C
+	}
+
+	for {
+		select {
+		case <-c.shutdownCh:
+			return
+		case now := <-releaseCh:
+			if err := c.exportTraces(context.Background(), c.traceBuffer.Release(now)); err != nil {
+				c.logger.Error("Failed to export metrics for buffered traces", zap.Error(err))
+			}
+		case <-flushCh:
+			if err := c.flushMetrics(context.Background()); err != nil {
+				c.logger.Error("Failed to export aggregated metrics", zap.Error(err))
+			}
+		}
+	}
+}
+
+// ConvertTraces converts a single batch of traces, nothing is kept from one call to the next
 func ConvertTraces(logger *zap.Logger, config *Config, td ptrace.Traces) pmetric.Metrics {
-	attributesFilter := NewAttributeFilter()
-	transactions := NewTransactionsMap(config.ApdexT)
-	meterProvider := NewMeterProvider()
+	metricsBuilder, err := NewMetricsBuilder(logger, config)
+	if err != nil {
+		logger.Error("Invalid APM connector configuration", zap.Error(err))
+		return pmetric.NewMetrics()
+	}
+	metricsBuilder.RecordTraces(td)
+	return metricsBuilder.Flush()
+}
+
+// MetricsBuilder turns traces into APM metrics. It holds what is built once from the
+// configuration, and the metrics aggregated until the next flush.
+type MetricsBuilder struct {
+	logger           *zap.Logger
+	config           *Config
+	meterProvider    *MeterProvider
+	attributesFilter *AttributeFilter
+	namer            *TransactionNamer
+	nameLimiter      *NameLimiter
+	errorClassifier  *ErrorClassifier
+}
+
+func NewMetricsBuilder(logger *zap.Logger, config *Config) (*MetricsBuilder, error) {
+	namer, err := NewTransactionNamer(config.NamingRules, config.OtherTransactionRules)
+	if err != nil {
+		return nil, err
+	}
+	errorClassifier, err := NewErrorClassifier(config.Errors)
+	if err != nil {
+		return nil, err
+	}
+	return &MetricsBuilder{logger: logger, config: config, meterProvider: NewMeterProvider(config.Metrics),
+		attributesFilter: NewAttributeFilterFromConfig(config.ResourceAttributes), namer: namer,
+		nameLimiter: NewNameLimiter(logger, config.CardinalityLimits), errorClassifier: errorClassifier}, nil
+}
+
+// Flush returns the metrics recorded since the last flush
+func (builder *MetricsBuilder) Flush() pmetric.Metrics {
+	return builder.meterProvider.Flush()
+}
 
+// RecordTraces records the metrics generated from td
+func (builder *MetricsBuilder) RecordTraces(td ptrace.Traces) {
+	logger := builder.logger
+	attributesFilter := builder.attributesFilter
+	meterProvider := builder.meterProvider
+	transactions := NewTransactionsMap(builder.config.ApdexT, builder.namer, builder.nameLimiter, builder.errorClassifier)
+
+	// index all the spans first, a child span can be in the batch before its parent
+	resourceMetricsBySpans := make([]*ResourceMetrics, td.ResourceSpans().Len())
 	for i := 0; i < td.ResourceSpans().Len(); i++ {
 		rs := td.ResourceSpans().At(i)
 		instrumentationProvider, instrumentationProviderPresent := rs.Resource().Attributes().Get("instrumentation.provider")
@@ -58,29 +218,41 @@ func ConvertTraces(logger *zap.Logger, config *Config, td ptrace.Traces) pmetric
 
 		resourceAttributes := attributesFilter.FilterAttributes(rs.Resource().Attributes())
 		resourceMetrics := meterProvider.getOrCreateResourceMetrics(resourceAttributes)
+		resourceMetricsBySpans[i] = resourceMetrics
+
+		for j := 0; j < rs.ScopeSpans().Len(); j++ {
+			scopeSpan := rs.ScopeSpans().At(j)
+			for k := 0; k < scopeSpan.Spans().Len(); k++ {
+				transactions.IndexSpan(scopeSpan.Spans().At(k), resourceMetrics)
+			}
+		}
+	}
+
+	for i := 0; i < td.ResourceSpans().Len(); i++ {
+		resourceMetrics := resourceMetricsBySpans[i]
+		if resourceMetrics == nil {
+			continue
+		}
+		rs := td.ResourceSpans().At(i)
 
 		sdkLanguage := GetSdkLanguage(rs.Resource().Attributes())
 		for j := 0; j < rs.ScopeSpans().Len(); j++ {
 			scopeSpan := rs.ScopeSpans().At(j)
 			for k := 0; k < scopeSpan.Spans().Len(); k++ {
 				span := scopeSpan.Spans().At(k)
-				if k == 0 {
-					if hostName, exists := resourceAttributes.Get("host.name"); exists {
-						GenerateInstanceMetric(resourceMetrics, hostName.AsString(), span.EndTimestamp())
-					}
+				if hostName, exists := rs.Resource().Attributes().Get("host.name"); exists {
+					GenerateInstanceMetric(resourceMetrics, hostName.AsString(), span.EndTimestamp())
 				}
 
 				transaction, _ := transactions.GetOrCreateTransaction(sdkLanguage, span, resourceMetrics)
 
 				//fmt.Printf("Span kind: %s Name: %s Trace Id: %s Span id: %s Parent: %s\n", span.Kind(), span.Name(), span.TraceID().String(), span.SpanID().String(), span.ParentSpanID().String())
 
-				transaction.AddSpan(span)
+				transaction.AddSpan(span, scopeSpan.Scope())
 			}
 		}
 
 	}
 
 	transactions.ProcessTransactions()
-
-	return meterProvider.Metrics
 }
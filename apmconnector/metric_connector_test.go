@@ -1,8 +1,13 @@
 package apmconnector
 
 import (
+	"context"
 	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/collector/component/componenttest"
+	"go.opentelemetry.io/collector/connector/connectortest"
+	"go.opentelemetry.io/collector/consumer/consumertest"
 	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/pmetric"
 	"go.opentelemetry.io/collector/pdata/ptrace"
 	"go.uber.org/zap"
 	"testing"
@@ -36,6 +41,128 @@ func TestConvertOneSpanToMetrics(t *testing.T) {
 	assert.Equal(t, 1.0, dp.Sum())
 }
 
+func TestConvertTraceAcrossServices(t *testing.T) {
+	traces := ptrace.NewTraces()
+	end := time.Now()
+	start := end.Add(-time.Second)
+
+	frontend := traces.ResourceSpans().AppendEmpty()
+	frontend.Resource().Attributes().PutStr("service.name", "frontend")
+	frontendSpans := frontend.ScopeSpans().AppendEmpty().Spans()
+	backend := traces.ResourceSpans().AppendEmpty()
+	backend.Resource().Attributes().PutStr("service.name", "backend")
+	backendSpans := backend.ScopeSpans().AppendEmpty().Spans()
+
+	server := newTestSpan([8]byte{1}, [8]byte{}, ptrace.SpanKindServer)
+	server.Attributes().PutStr("http.route", "/frontend")
+	client := newTestSpan([8]byte{2}, [8]byte{1}, ptrace.SpanKindClient)
+	client.Attributes().PutStr("server.address", "backend")
+	backendServer := newTestSpan([8]byte{3}, [8]byte{2}, ptrace.SpanKindServer)
+	backendServer.Attributes().PutStr("http.route", "/backend")
+	for _, span := range []ptrace.Span{server, client, backendServer} {
+		span.SetStartTimestamp(pcommon.NewTimestampFromTime(start))
+		span.SetEndTimestamp(pcommon.NewTimestampFromTime(end))
+	}
+	// the backend span is reported before the frontend spans
+	backendServer.CopyTo(backendSpans.AppendEmpty())
+	client.CopyTo(frontendSpans.AppendEmpty())
+	server.CopyTo(frontendSpans.AppendEmpty())
+
+	logger, _ := zap.NewDevelopment()
+	metrics := ConvertTraces(logger, &Config{ApdexT: 0.5}, traces)
+	assert.Equal(t, 2, metrics.ResourceMetrics().Len())
+
+	transactionNames := make(map[string]string)
+	for i := 0; i < metrics.ResourceMetrics().Len(); i++ {
+		rm := metrics.ResourceMetrics().At(i)
+		serviceName, _ := rm.Resource().Attributes().Get("service.name")
+		metricSlice := rm.ScopeMetrics().At(0).Metrics()
+		for j := 0; j < metricSlice.Len(); j++ {
+			if metricSlice.At(j).Name() == "apm.service.transaction.duration" {
+				dps := metricSlice.At(j).Histogram().DataPoints()
+				assert.Equal(t, 1, dps.Len())
+				name, _ := dps.At(0).Attributes().Get("transactionName")
+				transactionNames[serviceName.AsString()] = name.AsString()
+			}
+		}
+	}
+	assert.Equal(t, map[string]string{"frontend": "WebTransaction/http.route/frontend", "backend": "WebTransaction/http.route/backend"}, transactionNames)
+}
+
+func TestBufferedTracesFlushedOnShutdown(t *testing.T) {
+	traces := ptrace.NewTraces()
+	resourceSpans := traces.ResourceSpans().AppendEmpty()
+	resourceSpans.Resource().Attributes().PutStr("service.name", "service")
+	scopeSpans := resourceSpans.ScopeSpans().AppendEmpty().Spans()
+	end := time.Now()
+	start := end.Add(-time.Second)
+	addSpan(scopeSpans, map[string]string{}, []TestSpan{{Start: start, End: end, Name: "span", Kind: ptrace.SpanKindServer}})
+
+	sink := &consumertest.MetricsSink{}
+	config := createDefaultConfig().(*Config)
+	config.TraceBuffer.DecisionWait = time.Hour
+	connector, err := createTracesToMetrics(context.Background(), connectortest.NewNopCreateSettings(), config, sink)
+	assert.NoError(t, err)
+	assert.NoError(t, connector.Start(context.Background(), componenttest.NewNopHost()))
+
+	assert.NoError(t, connector.ConsumeTraces(context.Background(), traces))
+	assert.Equal(t, 0, len(sink.AllMetrics()))
+
+	assert.NoError(t, connector.Shutdown(context.Background()))
+	assert.Equal(t, 1, len(sink.AllMetrics()))
+	assert.Equal(t, 4, sink.AllMetrics()[0].MetricCount())
+
+	// shutting down again is a no-op
+	assert.NoError(t, connector.Shutdown(context.Background()))
+	assert.Equal(t, 1, len(sink.AllMetrics()))
+
+	// the traces would be buffered forever
+	assert.Error(t, connector.ConsumeTraces(context.Background(), traces))
+	assert.Equal(t, 1, len(sink.AllMetrics()))
+}
+
+func TestMetricsAggregatedOverFlushInterval(t *testing.T) {
+	sink := &consumertest.MetricsSink{}
+	config := createDefaultConfig().(*Config)
+	config.TraceBuffer.DecisionWait = 0
+	config.Metrics.FlushInterval = time.Hour
+	connector, err := createTracesToMetrics(context.Background(), connectortest.NewNopCreateSettings(), config, sink)
+	assert.NoError(t, err)
+	assert.NoError(t, connector.Start(context.Background(), componenttest.NewNopHost()))
+
+	for i := 0; i < 2; i++ {
+		traces := ptrace.NewTraces()
+		// the released buffered traces have a resource spans per trace
+		for j := 0; j < 2; j++ {
+			resourceSpans := traces.ResourceSpans().AppendEmpty()
+			resourceSpans.Resource().Attributes().PutStr("service.name", "service")
+			resourceSpans.Resource().Attributes().PutStr("host.name", "web-1")
+			end := time.Now()
+			start := end.Add(-time.Second)
+			addSpan(resourceSpans.ScopeSpans().AppendEmpty().Spans(), map[string]string{"http.route": "/users"},
+				[]TestSpan{{Start: start, End: end, Name: "span", Kind: ptrace.SpanKindServer}})
+			resourceSpans.ScopeSpans().At(0).Spans().At(0).SetTraceID([16]byte{byte(i), byte(j)})
+		}
+		assert.NoError(t, connector.ConsumeTraces(context.Background(), traces))
+	}
+	assert.Equal(t, 0, len(sink.AllMetrics()))
+
+	assert.NoError(t, connector.Shutdown(context.Background()))
+	assert.Equal(t, 1, len(sink.AllMetrics()))
+	metrics := make(map[string]pmetric.Metric)
+	metricSlice := sink.AllMetrics()[0].ResourceMetrics().At(0).ScopeMetrics().At(0).Metrics()
+	for i := 0; i < metricSlice.Len(); i++ {
+		metrics[metricSlice.At(i).Name()] = metricSlice.At(i)
+	}
+	duration := metrics["apm.service.transaction.duration"].Histogram().DataPoints()
+	assert.Equal(t, 1, duration.Len())
+	assert.Equal(t, uint64(4), duration.At(0).Count())
+	// one instance per flush interval, not per batch or trace
+	instances := metrics["apm.service.instance.count"].Sum().DataPoints()
+	assert.Equal(t, 1, instances.Len())
+	assert.Equal(t, int64(1), instances.At(0).IntValue())
+}
+
 func addSpan(spanSlice ptrace.SpanSlice, attributes map[string]string, spanValues []TestSpan) {
 	for _, spanValue := range spanValues {
 		span := spanSlice.AppendEmpty()
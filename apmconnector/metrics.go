@@ -4,25 +4,94 @@ import (
 	"crypto"
 	"fmt"
 	"sort"
+	"time"
 
 	"go.opentelemetry.io/collector/pdata/pcommon"
 	"go.opentelemetry.io/collector/pdata/pmetric"
 	"go.opentelemetry.io/collector/pdata/ptrace"
 )
 
+// DefaultHistogramBuckets are the explicit bucket boundaries, in seconds, of the duration histograms
+var DefaultHistogramBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.075, 0.1, 0.25, 0.5, 0.75, 1, 2.5, 5, 7.5, 10}
+
+// latencyMetricNames are the histograms sent as exponential histograms when configured
+var latencyMetricNames = map[string]bool{
+	"apm.service.transaction.duration":         true,
+	"apm.service.datastore.operation.duration": true,
+	"apm.service.datastore.instance.duration":  true,
+	"apm.service.external.host.duration":       true,
+}
+
 type MeterProvider struct {
+	config  MetricsConfig
 	Metrics pmetric.Metrics
 	// key is a hash of attributes
 	resourceMetrics map[string]*ResourceMetrics
+	// state of the cumulative counters, kept across flushes. The key is the hash of the
+	// resource attributes, the metric name and the hash of the data point attributes
+	cumulativeSums map[string]*cumulativeSum
+	// start of the current flush interval, used as the start timestamp of delta counters
+	intervalStart pcommon.Timestamp
+	now           func() time.Time
+}
+
+type cumulativeSum struct {
+	startTimestamp pcommon.Timestamp
+	value          int64
+	lastUpdated    time.Time
 }
 
 type ResourceMetrics struct {
-	metrics      pmetric.MetricSlice
-	nameToMetric map[string]pmetric.Metric
+	// hash of the resource attributes, identifies the service the metrics belong to
+	key         string
+	serviceName string
+	// name of the host reporting the metrics, when it is known
+	hostName      string
+	meterProvider *MeterProvider
+	metrics       pmetric.MetricSlice
+	nameToMetric  map[string]pmetric.Metric
+	// key is the metric name and a hash of the data point attributes
+	histogramDataPoints            map[string]pmetric.HistogramDataPoint
+	exponentialHistogramDataPoints map[string]*exponentialHistogramDataPoint
+	sumDataPoints                  map[string]pmetric.NumberDataPoint
+	// the instance is counted once per flush, whatever the number of batches
+	instanceRecorded bool
 }
 
-func NewMeterProvider() *MeterProvider {
-	return &MeterProvider{Metrics: pmetric.NewMetrics(), resourceMetrics: make(map[string]*ResourceMetrics)}
+type exponentialHistogramDataPoint struct {
+	dp        pmetric.ExponentialHistogramDataPoint
+	histogram *ExponentialHistogram
+}
+
+func NewMeterProvider(config MetricsConfig) *MeterProvider {
+	return &MeterProvider{config: config, Metrics: pmetric.NewMetrics(), resourceMetrics: make(map[string]*ResourceMetrics),
+		cumulativeSums: make(map[string]*cumulativeSum), intervalStart: pcommon.NewTimestampFromTime(time.Now()), now: time.Now}
+}
+
+// Flush returns the metrics recorded since the last flush, and starts aggregating new data points.
+// The buckets of the exponential histograms are copied into their data points only then.
+// Cumulative counters that have not been updated for longer than the staleness expiry are
+// forgotten, they start over from zero with a new start timestamp if they come back.
+func (meterProvider *MeterProvider) Flush() pmetric.Metrics {
+	now := meterProvider.now()
+	for _, resourceMetrics := range meterProvider.resourceMetrics {
+		for _, point := range resourceMetrics.exponentialHistogramDataPoints {
+			point.histogram.CopyTo(point.dp)
+		}
+	}
+	metrics := meterProvider.Metrics
+	meterProvider.Metrics = pmetric.NewMetrics()
+	meterProvider.resourceMetrics = make(map[string]*ResourceMetrics)
+	meterProvider.intervalStart = pcommon.NewTimestampFromTime(now)
+
+	if meterProvider.config.CounterStaleness > 0 {
+		for key, sum := range meterProvider.cumulativeSums {
+			if now.Sub(sum.lastUpdated) > meterProvider.config.CounterStaleness {
+				delete(meterProvider.cumulativeSums, key)
+			}
+		}
+	}
+	return metrics
 }
 
 func (meterProvider *MeterProvider) getOrCreateResourceMetrics(attributes pcommon.Map) *ResourceMetrics {
@@ -33,32 +102,108 @@ func (meterProvider *MeterProvider) getOrCreateResourceMetrics(attributes pcommo
 		resourceMetrics := meterProvider.Metrics.ResourceMetrics().AppendEmpty()
 		attributes.CopyTo(resourceMetrics.Resource().Attributes())
 		metrics := resourceMetrics.ScopeMetrics().AppendEmpty().Metrics()
-		rm := &ResourceMetrics{metrics: metrics, nameToMetric: make(map[string]pmetric.Metric)}
+		rm := &ResourceMetrics{key: key, meterProvider: meterProvider, metrics: metrics, nameToMetric: make(map[string]pmetric.Metric),
+			histogramDataPoints: make(map[string]pmetric.HistogramDataPoint), exponentialHistogramDataPoints: make(map[string]*exponentialHistogramDataPoint),
+			sumDataPoints: make(map[string]pmetric.NumberDataPoint)}
+		if serviceName, exists := attributes.Get("service.name"); exists {
+			rm.serviceName = serviceName.AsString()
+		}
+		for _, name := range []string{"host.name", "host"} {
+			if hostName, exists := attributes.Get(name); exists {
+				rm.hostName = hostName.AsString()
+				break
+			}
+		}
 		meterProvider.resourceMetrics[key] = rm
 		return rm
 	}
 }
 
-func (resourceMetrics ResourceMetrics) RecordHistogramFromSpan(metricName string, attributes pcommon.Map,
-	span ptrace.Span) pmetric.HistogramDataPoint {
-	return resourceMetrics.RecordHistogram(metricName, attributes, span.StartTimestamp(), span.EndTimestamp(), (span.EndTimestamp() - span.StartTimestamp()).AsTime().UnixNano())
+func (resourceMetrics *ResourceMetrics) RecordHistogramFromSpan(metricName string, attributes pcommon.Map,
+	span ptrace.Span) {
+	resourceMetrics.RecordHistogram(metricName, attributes, span.StartTimestamp(), span.EndTimestamp(), (span.EndTimestamp() - span.StartTimestamp()).AsTime().UnixNano())
 }
 
-func (metrics ResourceMetrics) RecordHistogram(metricName string, attributes pcommon.Map,
-	startTimestamp, endTimestamp pcommon.Timestamp, durationNanos int64) pmetric.HistogramDataPoint {
-
-	histogram := metrics.GetOrCreateHistogramMetric(metricName)
-	dp := histogram.DataPoints().AppendEmpty()
-	dp.SetStartTimestamp(startTimestamp)
-	dp.SetTimestamp(endTimestamp)
-	attributes.CopyTo(dp.Attributes())
+// RecordHistogram adds a duration to the data point with the same metric name and attributes,
+// creating it if this is the first duration recorded since the last flush
+func (metrics *ResourceMetrics) RecordHistogram(metricName string, attributes pcommon.Map,
+	startTimestamp, endTimestamp pcommon.Timestamp, durationNanos int64) {
 
 	duration := NanosToSeconds(durationNanos)
-	dp.SetSum(duration)
-	dp.SetCount(1)
-	dp.SetMin(duration)
-	dp.SetMax(duration)
-	return dp
+	if metrics.meterProvider.config.HistogramType == ExponentialHistogramType && latencyMetricNames[metricName] {
+		metrics.recordExponentialHistogram(metricName, attributes, startTimestamp, endTimestamp, duration)
+		return
+	}
+
+	buckets := metrics.meterProvider.config.GetHistogramBuckets(metricName)
+	key := metricName + GetKeyFromMap(attributes)
+	dp, exists := metrics.histogramDataPoints[key]
+	if !exists {
+		histogram := metrics.GetOrCreateHistogramMetric(metricName)
+		dp = histogram.DataPoints().AppendEmpty()
+		dp.SetStartTimestamp(startTimestamp)
+		dp.SetTimestamp(endTimestamp)
+		attributes.CopyTo(dp.Attributes())
+		dp.ExplicitBounds().FromRaw(buckets)
+		dp.BucketCounts().FromRaw(make([]uint64, len(buckets)+1))
+		dp.SetMin(duration)
+		dp.SetMax(duration)
+		metrics.histogramDataPoints[key] = dp
+	}
+
+	if startTimestamp < dp.StartTimestamp() {
+		dp.SetStartTimestamp(startTimestamp)
+	}
+	if endTimestamp > dp.Timestamp() {
+		dp.SetTimestamp(endTimestamp)
+	}
+	dp.SetSum(dp.Sum() + duration)
+	dp.SetCount(dp.Count() + 1)
+	if duration < dp.Min() {
+		dp.SetMin(duration)
+	}
+	if duration > dp.Max() {
+		dp.SetMax(duration)
+	}
+	// buckets are upper bound inclusive
+	bucket := sort.SearchFloat64s(buckets, duration)
+	dp.BucketCounts().SetAt(bucket, dp.BucketCounts().At(bucket)+1)
+}
+
+func (metrics *ResourceMetrics) recordExponentialHistogram(metricName string, attributes pcommon.Map,
+	startTimestamp, endTimestamp pcommon.Timestamp, duration float64) {
+
+	key := metricName + GetKeyFromMap(attributes)
+	point, exists := metrics.exponentialHistogramDataPoints[key]
+	if !exists {
+		histogram := metrics.GetOrCreateExponentialHistogramMetric(metricName)
+		dp := histogram.DataPoints().AppendEmpty()
+		dp.SetStartTimestamp(startTimestamp)
+		dp.SetTimestamp(endTimestamp)
+		attributes.CopyTo(dp.Attributes())
+		dp.SetMin(duration)
+		dp.SetMax(duration)
+		point = &exponentialHistogramDataPoint{dp: dp,
+			histogram: NewExponentialHistogram(metrics.meterProvider.config.ExponentialHistogram.MaxScale, metrics.meterProvider.config.ExponentialHistogram.MaxSize)}
+		metrics.exponentialHistogramDataPoints[key] = point
+	}
+
+	dp := point.dp
+	if startTimestamp < dp.StartTimestamp() {
+		dp.SetStartTimestamp(startTimestamp)
+	}
+	if endTimestamp > dp.Timestamp() {
+		dp.SetTimestamp(endTimestamp)
+	}
+	dp.SetSum(dp.Sum() + duration)
+	dp.SetCount(dp.Count() + 1)
+	if duration < dp.Min() {
+		dp.SetMin(duration)
+	}
+	if duration > dp.Max() {
+		dp.SetMax(duration)
+	}
+	point.histogram.Record(duration)
 }
 
 func (metrics *ResourceMetrics) GetOrCreateHistogramMetric(metricName string) pmetric.Histogram {
@@ -72,11 +217,26 @@ func (metrics *ResourceMetrics) GetOrCreateHistogramMetric(metricName string) pm
 	return metric.Histogram()
 }
 
+func (metrics *ResourceMetrics) GetOrCreateExponentialHistogramMetric(metricName string) pmetric.ExponentialHistogram {
+	init := func(metric pmetric.Metric) {
+		metric.SetUnit("s")
+
+		histogram := metric.SetEmptyExponentialHistogram()
+		histogram.SetAggregationTemporality(pmetric.AggregationTemporalityDelta)
+	}
+	metric := metrics.GetOrCreateMetric(metricName, init)
+	return metric.ExponentialHistogram()
+}
+
 func (metrics *ResourceMetrics) GetOrCreateSumMetric(metricName string) pmetric.Sum {
 	init := func(metric pmetric.Metric) {
 		sum := metric.SetEmptySum()
-		sum.SetAggregationTemporality(pmetric.AggregationTemporalityCumulative)
-		sum.SetIsMonotonic(false)
+		if metrics.meterProvider.config.CounterTemporality == CumulativeTemporality {
+			sum.SetAggregationTemporality(pmetric.AggregationTemporalityCumulative)
+		} else {
+			sum.SetAggregationTemporality(pmetric.AggregationTemporalityDelta)
+		}
+		sum.SetIsMonotonic(true)
 	}
 	metric := metrics.GetOrCreateMetric(metricName, init)
 	return metric.Sum()
@@ -94,17 +254,46 @@ func (metrics *ResourceMetrics) GetOrCreateMetric(metricName string, init func(p
 	}
 }
 
+// IncrementSum adds one to the counter with the same metric name and attributes. With delta
+// temporality the data point holds the count since the last flush, with cumulative temporality
+// it holds the count since the series was first seen.
 func (metrics *ResourceMetrics) IncrementSum(metricName string, attributes pcommon.Map,
-	timestamp pcommon.Timestamp) pmetric.NumberDataPoint {
+	timestamp pcommon.Timestamp) {
 
-	sum := metrics.GetOrCreateSumMetric(metricName)
-	dp := sum.DataPoints().AppendEmpty()
-	attributes.CopyTo(dp.Attributes())
+	attributesKey := GetKeyFromMap(attributes)
+	key := metricName + attributesKey
+	dp, exists := metrics.sumDataPoints[key]
+	if !exists {
+		sum := metrics.GetOrCreateSumMetric(metricName)
+		dp = sum.DataPoints().AppendEmpty()
+		attributes.CopyTo(dp.Attributes())
+		dp.SetStartTimestamp(metrics.meterProvider.intervalStart)
+		dp.SetTimestamp(timestamp)
+		metrics.sumDataPoints[key] = dp
+	}
+	if timestamp > dp.Timestamp() {
+		dp.SetTimestamp(timestamp)
+	}
 
-	dp.SetTimestamp(timestamp)
+	if metrics.meterProvider.config.CounterTemporality != CumulativeTemporality {
+		// late spans can end before the interval started
+		if timestamp < dp.StartTimestamp() {
+			dp.SetStartTimestamp(timestamp)
+		}
+		dp.SetIntValue(dp.IntValue() + 1)
+		return
+	}
 
-	dp.SetIntValue(1)
-	return dp
+	cumulativeKey := metrics.key + key
+	state, stateExists := metrics.meterProvider.cumulativeSums[cumulativeKey]
+	if !stateExists {
+		state = &cumulativeSum{startTimestamp: timestamp}
+		metrics.meterProvider.cumulativeSums[cumulativeKey] = state
+	}
+	state.value++
+	state.lastUpdated = metrics.meterProvider.now()
+	dp.SetStartTimestamp(state.startTimestamp)
+	dp.SetIntValue(state.value)
 }
 
 func NanosToSeconds(nanos int64) float64 {
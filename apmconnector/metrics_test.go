@@ -3,11 +3,13 @@ package apmconnector
 import (
 	"github.com/stretchr/testify/assert"
 	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/pmetric"
 	"testing"
+	"time"
 )
 
 func TestGetOrCreateResourceMetrics(t *testing.T) {
-	meter := NewMeterProvider()
+	meter := NewMeterProvider(MetricsConfig{})
 	attributes := pcommon.NewMap()
 	attributes.PutStr("name", "test")
 	attributes.PutInt("id", 5)
@@ -19,3 +21,165 @@ func TestGetOrCreateResourceMetrics(t *testing.T) {
 	metrics2 := meter.getOrCreateResourceMetrics(attributes)
 	assert.Equal(t, metrics, metrics2)
 }
+
+func TestRecordHistogramAggregatesDataPoints(t *testing.T) {
+	meter := NewMeterProvider(MetricsConfig{HistogramBuckets: []float64{0.1, 1}})
+	metrics := meter.getOrCreateResourceMetrics(pcommon.NewMap())
+
+	attributes := pcommon.NewMap()
+	attributes.PutStr("transactionName", "WebTransaction/http.route/users")
+	otherAttributes := pcommon.NewMap()
+	otherAttributes.PutStr("transactionName", "WebTransaction/http.route/owners")
+
+	metrics.RecordHistogram("apm.service.transaction.duration", attributes, 20, 30, 50e6)
+	metrics.RecordHistogram("apm.service.transaction.duration", attributes, 10, 40, 1e9)
+	metrics.RecordHistogram("apm.service.transaction.duration", attributes, 15, 35, 2e9)
+	metrics.RecordHistogram("apm.service.transaction.duration", otherAttributes, 15, 35, 2e9)
+
+	dps := metrics.nameToMetric["apm.service.transaction.duration"].Histogram().DataPoints()
+	assert.Equal(t, 2, dps.Len())
+	dp := dps.At(0)
+	assert.Equal(t, uint64(3), dp.Count())
+	assert.Equal(t, 3.05, dp.Sum())
+	assert.Equal(t, 0.05, dp.Min())
+	assert.Equal(t, 2.0, dp.Max())
+	assert.Equal(t, pcommon.Timestamp(10), dp.StartTimestamp())
+	assert.Equal(t, pcommon.Timestamp(40), dp.Timestamp())
+	assert.Equal(t, []float64{0.1, 1}, dp.ExplicitBounds().AsRaw())
+	assert.Equal(t, []uint64{1, 1, 1}, dp.BucketCounts().AsRaw())
+}
+
+func TestRecordHistogramMetricBuckets(t *testing.T) {
+	meter := NewMeterProvider(MetricsConfig{HistogramBuckets: []float64{0.1, 1},
+		MetricHistogramBuckets: map[string][]float64{"apm.service.external.host.duration": {0.5}}})
+	metrics := meter.getOrCreateResourceMetrics(pcommon.NewMap())
+
+	metrics.RecordHistogram("apm.service.external.host.duration", pcommon.NewMap(), 0, 1, 1e9)
+	dp := metrics.nameToMetric["apm.service.external.host.duration"].Histogram().DataPoints().At(0)
+	assert.Equal(t, []float64{0.5}, dp.ExplicitBounds().AsRaw())
+	assert.Equal(t, []uint64{0, 1}, dp.BucketCounts().AsRaw())
+}
+
+func TestMeterProviderFlush(t *testing.T) {
+	meter := NewMeterProvider(MetricsConfig{})
+	meter.getOrCreateResourceMetrics(pcommon.NewMap()).RecordHistogram("apm.service.transaction.duration", pcommon.NewMap(), 0, 1, 1e9)
+
+	metrics := meter.Flush()
+	assert.Equal(t, 1, metrics.DataPointCount())
+	assert.Equal(t, 0, meter.Flush().DataPointCount())
+
+	meter.getOrCreateResourceMetrics(pcommon.NewMap()).RecordHistogram("apm.service.transaction.duration", pcommon.NewMap(), 0, 1, 1e9)
+	metrics = meter.Flush()
+	assert.Equal(t, 1, metrics.DataPointCount())
+	assert.Equal(t, uint64(1), metrics.ResourceMetrics().At(0).ScopeMetrics().At(0).Metrics().At(0).Histogram().DataPoints().At(0).Count())
+}
+
+func TestRecordExponentialHistogram(t *testing.T) {
+	meter := NewMeterProvider(MetricsConfig{HistogramType: ExponentialHistogramType,
+		ExponentialHistogram: ExponentialHistogramConfig{MaxScale: 20, MaxSize: 160}})
+	metrics := meter.getOrCreateResourceMetrics(pcommon.NewMap())
+
+	metrics.RecordHistogram("apm.service.transaction.duration", pcommon.NewMap(), 10, 20, 1e9)
+	metrics.RecordHistogram("apm.service.transaction.duration", pcommon.NewMap(), 5, 30, 250e6)
+	// only the latency metrics are exponential
+	metrics.RecordHistogram("apm.service.overview.web", pcommon.NewMap(), 5, 30, 250e6)
+
+	metric := metrics.nameToMetric["apm.service.transaction.duration"]
+	assert.Equal(t, pmetric.MetricTypeExponentialHistogram, metric.Type())
+	assert.Equal(t, pmetric.AggregationTemporalityDelta, metric.ExponentialHistogram().AggregationTemporality())
+	dps := metric.ExponentialHistogram().DataPoints()
+	assert.Equal(t, 1, dps.Len())
+	dp := dps.At(0)
+	assert.Equal(t, uint64(2), dp.Count())
+	assert.Equal(t, 1.25, dp.Sum())
+	assert.Equal(t, 0.25, dp.Min())
+	assert.Equal(t, 1.0, dp.Max())
+	assert.Equal(t, pcommon.Timestamp(5), dp.StartTimestamp())
+	assert.Equal(t, pcommon.Timestamp(30), dp.Timestamp())
+
+	assert.Equal(t, pmetric.MetricTypeHistogram, metrics.nameToMetric["apm.service.overview.web"].Type())
+
+	// the buckets are filled when flushing
+	assert.Equal(t, 0, dp.Positive().BucketCounts().Len())
+	meter.Flush()
+	assert.True(t, dp.Positive().BucketCounts().Len() > 0)
+	assert.True(t, dp.Positive().BucketCounts().Len() <= 160)
+	bucketTotal := uint64(0)
+	for _, count := range dp.Positive().BucketCounts().AsRaw() {
+		bucketTotal += count
+	}
+	assert.Equal(t, uint64(2), bucketTotal+dp.ZeroCount())
+}
+
+func TestIncrementSumDelta(t *testing.T) {
+	meter := NewMeterProvider(MetricsConfig{CounterTemporality: DeltaTemporality})
+	metrics := meter.getOrCreateResourceMetrics(pcommon.NewMap())
+	attributes := pcommon.NewMap()
+	attributes.PutStr("apdex.bucket", "S")
+	otherAttributes := pcommon.NewMap()
+	otherAttributes.PutStr("apdex.bucket", "F")
+
+	intervalStart := meter.intervalStart
+	metrics.IncrementSum("apm.service.apdex", attributes, intervalStart+10)
+	metrics.IncrementSum("apm.service.apdex", attributes, intervalStart+20)
+	metrics.IncrementSum("apm.service.apdex", otherAttributes, intervalStart+15)
+
+	sum := metrics.nameToMetric["apm.service.apdex"].Sum()
+	assert.True(t, sum.IsMonotonic())
+	assert.Equal(t, pmetric.AggregationTemporalityDelta, sum.AggregationTemporality())
+	assert.Equal(t, 2, sum.DataPoints().Len())
+	assert.Equal(t, int64(2), sum.DataPoints().At(0).IntValue())
+	assert.Equal(t, intervalStart, sum.DataPoints().At(0).StartTimestamp())
+	assert.Equal(t, intervalStart+20, sum.DataPoints().At(0).Timestamp())
+	assert.Equal(t, int64(1), sum.DataPoints().At(1).IntValue())
+
+	meter.Flush()
+	metrics = meter.getOrCreateResourceMetrics(pcommon.NewMap())
+	metrics.IncrementSum("apm.service.apdex", attributes, meter.intervalStart+10)
+	dp := metrics.nameToMetric["apm.service.apdex"].Sum().DataPoints().At(0)
+	assert.Equal(t, int64(1), dp.IntValue())
+	assert.Equal(t, meter.intervalStart, dp.StartTimestamp())
+}
+
+func TestIncrementSumCumulative(t *testing.T) {
+	now := time.Unix(1000, 0)
+	meter := NewMeterProvider(MetricsConfig{CounterTemporality: CumulativeTemporality, CounterStaleness: time.Minute})
+	meter.now = func() time.Time { return now }
+
+	meter.getOrCreateResourceMetrics(pcommon.NewMap()).IncrementSum("apm.service.error.count", pcommon.NewMap(), 100)
+	meter.getOrCreateResourceMetrics(pcommon.NewMap()).IncrementSum("apm.service.error.count", pcommon.NewMap(), 200)
+	first := meter.Flush().ResourceMetrics().At(0).ScopeMetrics().At(0).Metrics().At(0).Sum()
+	assert.Equal(t, pmetric.AggregationTemporalityCumulative, first.AggregationTemporality())
+	assert.True(t, first.IsMonotonic())
+	assert.Equal(t, int64(2), first.DataPoints().At(0).IntValue())
+	assert.Equal(t, pcommon.Timestamp(100), first.DataPoints().At(0).StartTimestamp())
+
+	now = now.Add(30 * time.Second)
+	meter.getOrCreateResourceMetrics(pcommon.NewMap()).IncrementSum("apm.service.error.count", pcommon.NewMap(), 300)
+	second := meter.Flush().ResourceMetrics().At(0).ScopeMetrics().At(0).Metrics().At(0).Sum()
+	assert.Equal(t, int64(3), second.DataPoints().At(0).IntValue())
+	assert.Equal(t, pcommon.Timestamp(100), second.DataPoints().At(0).StartTimestamp())
+	assert.Equal(t, pcommon.Timestamp(300), second.DataPoints().At(0).Timestamp())
+
+	// the series goes stale and starts over
+	now = now.Add(2 * time.Minute)
+	meter.Flush()
+	meter.getOrCreateResourceMetrics(pcommon.NewMap()).IncrementSum("apm.service.error.count", pcommon.NewMap(), 400)
+	third := meter.Flush().ResourceMetrics().At(0).ScopeMetrics().At(0).Metrics().At(0).Sum()
+	assert.Equal(t, int64(1), third.DataPoints().At(0).IntValue())
+	assert.Equal(t, pcommon.Timestamp(400), third.DataPoints().At(0).StartTimestamp())
+}
+
+func TestIncrementSumCumulativePerResource(t *testing.T) {
+	meter := NewMeterProvider(MetricsConfig{CounterTemporality: CumulativeTemporality})
+	attributes := pcommon.NewMap()
+	attributes.PutStr("service.name", "other")
+
+	meter.getOrCreateResourceMetrics(pcommon.NewMap()).IncrementSum("apm.service.error.count", pcommon.NewMap(), 100)
+	meter.getOrCreateResourceMetrics(attributes).IncrementSum("apm.service.error.count", pcommon.NewMap(), 100)
+	metrics := meter.Flush()
+	for i := 0; i < metrics.ResourceMetrics().Len(); i++ {
+		dp := metrics.ResourceMetrics().At(i).ScopeMetrics().At(0).Metrics().At(0).Sum().DataPoints().At(0)
+		assert.Equal(t, int64(1), dp.IntValue())
+	}
+}
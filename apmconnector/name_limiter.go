@@ -0,0 +1,132 @@
+package apmconnector
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.uber.org/zap"
+)
+
+const (
+	transactionNameLimit = "transactionName"
+	segmentNameLimit     = "segmentName"
+)
+
+// NameLimiter caps the number of distinct transaction and segment names of each service, all
+// the instances of a service share the limit. A name counts toward the limit until it has not
+// been seen for a whole window, names over the limit are replaced by an overflow name. It is
+// not safe for concurrent use.
+type NameLimiter struct {
+	logger   *zap.Logger
+	config   CardinalityLimitsConfig
+	services map[string]*serviceNames
+	now      func() time.Time
+	// last time the services that went away were removed
+	lastPruned time.Time
+}
+
+type serviceNames struct {
+	// last time each name was seen
+	transactionNames map[string]time.Time
+	segmentNames     map[string]time.Time
+}
+
+func NewNameLimiter(logger *zap.Logger, config CardinalityLimitsConfig) *NameLimiter {
+	return &NameLimiter{logger: logger, config: config, services: make(map[string]*serviceNames), now: time.Now}
+}
+
+// LimitTransactionName returns the name to record the transaction with
+func (limiter *NameLimiter) LimitTransactionName(resourceMetrics *ResourceMetrics, name string, transactionType TransactionType,
+	timestamp pcommon.Timestamp) string {
+
+	if limiter == nil || limiter.config.MaxTransactionNames <= 0 {
+		return name
+	}
+	names := limiter.getOrCreateServiceNames(resourceMetrics)
+	if limiter.admit(names.transactionNames, limiter.config.MaxTransactionNames, name) {
+		return name
+	}
+	limiter.overflow(resourceMetrics, transactionNameLimit, limiter.config.MaxTransactionNames, name, timestamp)
+	return fmt.Sprintf("%sTransaction/Other/overflow", transactionType.AsString())
+}
+
+// LimitSegmentName returns the metric timeslice name to record a measurement with
+func (limiter *NameLimiter) LimitSegmentName(resourceMetrics *ResourceMetrics, name string, timestamp pcommon.Timestamp) string {
+	if limiter == nil || limiter.config.MaxSegmentNames <= 0 {
+		return name
+	}
+	names := limiter.getOrCreateServiceNames(resourceMetrics)
+	if limiter.admit(names.segmentNames, limiter.config.MaxSegmentNames, name) {
+		return name
+	}
+	limiter.overflow(resourceMetrics, segmentNameLimit, limiter.config.MaxSegmentNames, name, timestamp)
+	// keep the category, Datastore/statement/... becomes Datastore/overflow
+	category, _, _ := strings.Cut(name, "/")
+	return category + "/overflow"
+}
+
+func (limiter *NameLimiter) getOrCreateServiceNames(resourceMetrics *ResourceMetrics) *serviceNames {
+	limiter.prune()
+	names, exists := limiter.services[resourceMetrics.serviceName]
+	if !exists {
+		names = &serviceNames{transactionNames: make(map[string]time.Time), segmentNames: make(map[string]time.Time)}
+		limiter.services[resourceMetrics.serviceName] = names
+	}
+	return names
+}
+
+// prune removes, once per window, the names not seen for a whole window and the services left without names
+func (limiter *NameLimiter) prune() {
+	now := limiter.now()
+	if now.Sub(limiter.lastPruned) <= limiter.config.Window {
+		return
+	}
+	limiter.lastPruned = now
+	for serviceName, names := range limiter.services {
+		for _, knownNames := range []map[string]time.Time{names.transactionNames, names.segmentNames} {
+			for knownName, lastSeen := range knownNames {
+				if now.Sub(lastSeen) > limiter.config.Window {
+					delete(knownNames, knownName)
+				}
+			}
+		}
+		if len(names.transactionNames) == 0 && len(names.segmentNames) == 0 {
+			delete(limiter.services, serviceName)
+		}
+	}
+}
+
+// admit returns true when the name is already known or there is room for it
+func (limiter *NameLimiter) admit(names map[string]time.Time, max int, name string) bool {
+	now := limiter.now()
+	if _, exists := names[name]; exists {
+		names[name] = now
+		return true
+	}
+	if len(names) >= max {
+		for knownName, lastSeen := range names {
+			if now.Sub(lastSeen) > limiter.config.Window {
+				delete(names, knownName)
+			}
+		}
+	}
+	if len(names) >= max {
+		return false
+	}
+	names[name] = now
+	return true
+}
+
+// overflow counts and logs every name rolled into the overflow name
+func (limiter *NameLimiter) overflow(resourceMetrics *ResourceMetrics, limit string, max int, name string,
+	timestamp pcommon.Timestamp) {
+
+	attributes := pcommon.NewMap()
+	attributes.PutStr("limit", limit)
+	resourceMetrics.IncrementSum("apm.service.cardinality.overflow.count", attributes, timestamp)
+	limiter.logger.Warn("Service has too many distinct names, new names are recorded as overflow",
+		zap.String("service.name", resourceMetrics.serviceName), zap.String("limit", limit), zap.Int("max", max),
+		zap.String("name", name))
+}
@@ -0,0 +1,101 @@
+package apmconnector
+
+import (
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"testing"
+	"time"
+)
+
+func TestLimitTransactionName(t *testing.T) {
+	core, logs := observer.New(zapcore.WarnLevel)
+	limiter := NewNameLimiter(zap.New(core), CardinalityLimitsConfig{MaxTransactionNames: 2, Window: time.Hour})
+	metrics := newLimiterTestResourceMetrics("frontend")
+
+	assert.Equal(t, "WebTransaction/Uri/a", limiter.LimitTransactionName(metrics, "WebTransaction/Uri/a", WebTransactionType, 1))
+	assert.Equal(t, "WebTransaction/Uri/b", limiter.LimitTransactionName(metrics, "WebTransaction/Uri/b", WebTransactionType, 1))
+	assert.Equal(t, "WebTransaction/Other/overflow", limiter.LimitTransactionName(metrics, "WebTransaction/Uri/c", WebTransactionType, 1))
+	assert.Equal(t, "OtherTransaction/Other/overflow", limiter.LimitTransactionName(metrics, "OtherTransaction/Job/d", OtherTransactionType, 1))
+	// known names are still accepted
+	assert.Equal(t, "WebTransaction/Uri/a", limiter.LimitTransactionName(metrics, "WebTransaction/Uri/a", WebTransactionType, 1))
+
+	overflow := metrics.nameToMetric["apm.service.cardinality.overflow.count"].Sum().DataPoints()
+	assert.Equal(t, 1, overflow.Len())
+	assert.Equal(t, int64(2), overflow.At(0).IntValue())
+	limit, _ := overflow.At(0).Attributes().Get("limit")
+	assert.Equal(t, "transactionName", limit.AsString())
+
+	// logged every time
+	assert.Equal(t, 2, logs.Len())
+	assert.Equal(t, "frontend", logs.All()[0].ContextMap()["service.name"])
+	assert.Equal(t, "OtherTransaction/Job/d", logs.All()[1].ContextMap()["name"])
+}
+
+func TestLimitTransactionNameWindow(t *testing.T) {
+	now := time.Unix(1000, 0)
+	limiter := NewNameLimiter(zap.NewNop(), CardinalityLimitsConfig{MaxTransactionNames: 1, Window: time.Minute})
+	limiter.now = func() time.Time { return now }
+	metrics := newLimiterTestResourceMetrics("frontend")
+
+	assert.Equal(t, "WebTransaction/Uri/a", limiter.LimitTransactionName(metrics, "WebTransaction/Uri/a", WebTransactionType, 1))
+	assert.Equal(t, "WebTransaction/Other/overflow", limiter.LimitTransactionName(metrics, "WebTransaction/Uri/b", WebTransactionType, 1))
+
+	now = now.Add(2 * time.Minute)
+	assert.Equal(t, "WebTransaction/Uri/b", limiter.LimitTransactionName(metrics, "WebTransaction/Uri/b", WebTransactionType, 1))
+	assert.Equal(t, "WebTransaction/Other/overflow", limiter.LimitTransactionName(metrics, "WebTransaction/Uri/a", WebTransactionType, 1))
+}
+
+func TestLimitSegmentNamePerService(t *testing.T) {
+	limiter := NewNameLimiter(zap.NewNop(), CardinalityLimitsConfig{MaxSegmentNames: 1, Window: time.Hour})
+	frontend := newLimiterTestResourceMetrics("frontend")
+	backend := newLimiterTestResourceMetrics("backend")
+
+	assert.Equal(t, "Custom/a", limiter.LimitSegmentName(frontend, "Custom/a", 1))
+	assert.Equal(t, "Custom/overflow", limiter.LimitSegmentName(frontend, "Custom/b", 1))
+	assert.Equal(t, "Datastore/overflow", limiter.LimitSegmentName(frontend, "Datastore/statement/mysql/users/select", 1))
+	assert.Equal(t, "Custom/b", limiter.LimitSegmentName(backend, "Custom/b", 1))
+}
+
+func TestNoNameLimiter(t *testing.T) {
+	var limiter *NameLimiter
+	metrics := newLimiterTestResourceMetrics("frontend")
+	assert.Equal(t, "WebTransaction/Uri/a", limiter.LimitTransactionName(metrics, "WebTransaction/Uri/a", WebTransactionType, 1))
+	assert.Equal(t, "Custom/a", limiter.LimitSegmentName(metrics, "Custom/a", 1))
+}
+
+func newLimiterTestResourceMetrics(serviceName string) *ResourceMetrics {
+	attributes := pcommon.NewMap()
+	attributes.PutStr("service.name", serviceName)
+	return NewMeterProvider(MetricsConfig{}).getOrCreateResourceMetrics(attributes)
+}
+
+func TestLimitNamesAcrossInstances(t *testing.T) {
+	limiter := NewNameLimiter(zap.NewNop(), CardinalityLimitsConfig{MaxTransactionNames: 1, Window: time.Hour})
+	meterProvider := NewMeterProvider(MetricsConfig{})
+	instances := make([]*ResourceMetrics, 2)
+	for i, hostName := range []string{"web-1", "web-2"} {
+		attributes := pcommon.NewMap()
+		attributes.PutStr("service.name", "frontend")
+		attributes.PutStr("host.name", hostName)
+		instances[i] = meterProvider.getOrCreateResourceMetrics(attributes)
+	}
+
+	assert.Equal(t, "WebTransaction/Uri/a", limiter.LimitTransactionName(instances[0], "WebTransaction/Uri/a", WebTransactionType, 1))
+	assert.Equal(t, "WebTransaction/Other/overflow", limiter.LimitTransactionName(instances[1], "WebTransaction/Uri/b", WebTransactionType, 1))
+}
+
+func TestPruneServices(t *testing.T) {
+	now := time.Unix(1000, 0)
+	limiter := NewNameLimiter(zap.NewNop(), CardinalityLimitsConfig{MaxTransactionNames: 1, Window: time.Minute})
+	limiter.now = func() time.Time { return now }
+
+	limiter.LimitTransactionName(newLimiterTestResourceMetrics("frontend"), "WebTransaction/Uri/a", WebTransactionType, 1)
+	now = now.Add(2 * time.Minute)
+	limiter.LimitTransactionName(newLimiterTestResourceMetrics("backend"), "WebTransaction/Uri/a", WebTransactionType, 1)
+	assert.Equal(t, 1, len(limiter.services))
+	_, exists := limiter.services["backend"]
+	assert.True(t, exists)
+}
@@ -0,0 +1,102 @@
+package apmconnector
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+)
+
+const (
+	RpcSystemAttributeName         = "rpc.system"
+	RpcServiceAttributeName        = "rpc.service"
+	RpcMethodAttributeName         = "rpc.method"
+	RpcGrpcStatusCodeAttributeName = "rpc.grpc.status_code"
+)
+
+// grpcServerErrorCodes are the gRPC status codes that are errors for the server,
+// codes such as NOT_FOUND or INVALID_ARGUMENT are caused by the client
+var grpcServerErrorCodes = map[int64]bool{
+	2:  true, // UNKNOWN
+	4:  true, // DEADLINE_EXCEEDED
+	12: true, // UNIMPLEMENTED
+	13: true, // INTERNAL
+	14: true, // UNAVAILABLE
+	15: true, // DATA_LOSS
+}
+
+var rpcSystemLabels = map[string]string{
+	"grpc":         "gRPC",
+	"apache_dubbo": "Dubbo",
+	"connect_rpc":  "ConnectRPC",
+	"dotnet_wcf":   "WCF",
+	"java_rmi":     "RMI",
+	"thrift":       "Thrift",
+}
+
+func GetRpcSystemLabel(rpcSystem string) string {
+	if label, exists := rpcSystemLabels[rpcSystem]; exists {
+		return label
+	}
+	return rpcSystem
+}
+
+// GetRpcServiceAndMethod returns rpc.service and rpc.method, falling back on the
+// span name, which is {service}/{method} for RPC spans
+func GetRpcServiceAndMethod(span ptrace.Span) (string, string) {
+	service, method := "unknown", strings.TrimPrefix(span.Name(), "/")
+	if i := strings.LastIndex(method, "/"); i >= 0 {
+		service, method = method[:i], method[i+1:]
+	}
+	if rpcService, exists := span.Attributes().Get(RpcServiceAttributeName); exists {
+		service = rpcService.AsString()
+	}
+	if rpcMethod, exists := span.Attributes().Get(RpcMethodAttributeName); exists {
+		method = rpcMethod.AsString()
+	}
+	return service, method
+}
+
+func GetRpcTransactionMetricName(span ptrace.Span, rpcSystem string) (string, TransactionType) {
+	service, method := GetRpcServiceAndMethod(span)
+	return fmt.Sprintf("WebTransaction/%s/%s/%s", GetRpcSystemLabel(rpcSystem), service, method), WebTransactionType
+}
+
+// IsRpcServerError returns true for the gRPC status codes that are server errors
+func IsRpcServerError(span ptrace.Span) bool {
+	if statusCode, exists := span.Attributes().Get(RpcGrpcStatusCodeAttributeName); exists {
+		// some instrumentations send the code as a string
+		code, err := strconv.ParseInt(statusCode.AsString(), 10, 64)
+		return err == nil && grpcServerErrorCodes[code]
+	}
+	return false
+}
+
+// ProcessRpcSpan records a client RPC call as an external call to the remote service and method
+func (transaction *Transaction) ProcessRpcSpan(span ptrace.Span) bool {
+	rpcSystem, rpcSystemPresent := span.Attributes().Get(RpcSystemAttributeName)
+	if !rpcSystemPresent {
+		return false
+	}
+	service, method := GetRpcServiceAndMethod(span)
+	host := service
+	if serverAddress, exists := ServerAddressAttribute.Get(span.Attributes()); exists {
+		host = serverAddress.AsString()
+	}
+
+	attributes := pcommon.NewMap()
+	attributes.PutStr("external.host", host)
+	attributes.PutStr(RpcSystemAttributeName, rpcSystem.AsString())
+	attributes.PutStr(RpcServiceAttributeName, service)
+	attributes.PutStr(RpcMethodAttributeName, method)
+
+	timesliceName := fmt.Sprintf("External/%s/%s/%s/%s", host, GetRpcSystemLabel(rpcSystem.AsString()), service, method)
+	measurement := Measurement{SpanId: span.SpanID().String(), MetricName: "apm.service.external.host.duration", Span: span,
+		DurationNanos: DurationInNanos(span), Attributes: attributes, SegmentNameProvider: ExternalSegmentNameProvider, MetricTimesliceName: timesliceName,
+		Category: HttpSpanCategory}
+
+	transaction.AddMeasurement(&measurement)
+	return true
+}
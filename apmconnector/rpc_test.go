@@ -0,0 +1,86 @@
+package apmconnector
+
+import (
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+	"testing"
+)
+
+func TestGetTransactionMetricNameGrpc(t *testing.T) {
+	span := ptrace.NewSpan()
+	span.SetKind(ptrace.SpanKindServer)
+	span.Attributes().PutStr("rpc.system", "grpc")
+	span.Attributes().PutStr("rpc.service", "shop.CartService")
+	span.Attributes().PutStr("rpc.method", "AddItem")
+
+	name, txType := GetTransactionMetricName(span)
+	assert.Equal(t, "WebTransaction/gRPC/shop.CartService/AddItem", name)
+	assert.Equal(t, WebTransactionType, txType)
+}
+
+func TestGetTransactionMetricNameRpcWithoutMethod(t *testing.T) {
+	span := ptrace.NewSpan()
+	span.SetKind(ptrace.SpanKindServer)
+	span.SetName("Calculator/add")
+	span.Attributes().PutStr("rpc.system", "thrift")
+
+	name, _ := GetTransactionMetricName(span)
+	assert.Equal(t, "WebTransaction/Thrift/Calculator/add", name)
+
+	span.SetName("add")
+	name, _ = GetTransactionMetricName(span)
+	assert.Equal(t, "WebTransaction/Thrift/unknown/add", name)
+}
+
+func TestIsRpcServerError(t *testing.T) {
+	span := ptrace.NewSpan()
+	assert.False(t, IsErrorSpan(span))
+
+	span.Attributes().PutInt("rpc.grpc.status_code", 5)
+	assert.False(t, IsErrorSpan(span))
+
+	span.Attributes().PutInt("rpc.grpc.status_code", 13)
+	assert.True(t, IsErrorSpan(span))
+
+	span.Attributes().PutStr("rpc.grpc.status_code", "14")
+	assert.True(t, IsErrorSpan(span))
+}
+
+func TestProcessRpcClientSpan(t *testing.T) {
+	transactions := NewTransactionsMap(0.5, &TransactionNamer{}, nil, nil)
+	metrics := NewMeterProvider(MetricsConfig{}).getOrCreateResourceMetrics(pcommon.NewMap())
+
+	root := newTimedTestSpan([8]byte{1}, [8]byte{}, ptrace.SpanKindServer, 0, 100)
+	root.Attributes().PutStr("rpc.system", "grpc")
+	root.Attributes().PutStr("rpc.service", "shop.CheckoutService")
+	root.Attributes().PutStr("rpc.method", "PlaceOrder")
+	root.Attributes().PutInt("rpc.grpc.status_code", 13)
+	client := newTimedTestSpan([8]byte{2}, [8]byte{1}, ptrace.SpanKindClient, 10, 60)
+	client.Attributes().PutStr("rpc.system", "grpc")
+	client.Attributes().PutStr("rpc.service", "shop.PaymentService")
+	client.Attributes().PutStr("rpc.method", "Charge")
+	client.Attributes().PutStr("server.address", "payment")
+
+	for _, span := range []ptrace.Span{root, client} {
+		transactions.IndexSpan(span, metrics)
+	}
+	for _, span := range []ptrace.Span{root, client} {
+		transaction, _ := transactions.GetOrCreateTransaction("go", span, metrics)
+		transaction.AddSpan(span, pcommon.NewInstrumentationScope())
+	}
+	transactions.ProcessTransactions()
+
+	for _, transaction := range transactions.Transactions {
+		measurement := transaction.Measurements[client.SpanID().String()]
+		assert.Equal(t, "External/payment/gRPC/shop.PaymentService/Charge", measurement.MetricTimesliceName)
+		assert.Equal(t, "apm.service.external.host.duration", measurement.MetricName)
+		method, _ := measurement.Attributes.Get("rpc.method")
+		assert.Equal(t, "Charge", method.AsString())
+	}
+
+	errors := metrics.nameToMetric["apm.service.transaction.error.count"].Sum().DataPoints()
+	assert.Equal(t, 1, errors.Len())
+	name, _ := errors.At(0).Attributes().Get("transactionName")
+	assert.Equal(t, "WebTransaction/gRPC/shop.CheckoutService/PlaceOrder", name.AsString())
+}
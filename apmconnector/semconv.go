@@ -0,0 +1,36 @@
+package apmconnector
+
+import (
+	"go.opentelemetry.io/collector/pdata/pcommon"
+)
+
+// SemconvAttribute is an attribute that was renamed across the semantic convention releases.
+// The names are tried in order, from the most recent release to the oldest one.
+type SemconvAttribute []string
+
+var (
+	HttpRequestMethodAttribute      = SemconvAttribute{"http.request.method", "http.method"}
+	HttpResponseStatusCodeAttribute = SemconvAttribute{"http.response.status_code", "http.status_code"}
+	UrlFullAttribute                = SemconvAttribute{"url.full", "http.url"}
+	// http.target also contains the query string
+	UrlPathAttribute                  = SemconvAttribute{"url.path", "http.target"}
+	ServerAddressAttribute            = SemconvAttribute{"server.address", "net.peer.name"}
+	ServerPortAttribute               = SemconvAttribute{"server.port", "net.peer.port"}
+	DbSystemAttribute                 = SemconvAttribute{"db.system.name", DbSystemAttributeName}
+	DbOperationAttribute              = SemconvAttribute{"db.operation.name", DbOperationAttributeName}
+	DbQueryTextAttribute              = SemconvAttribute{"db.query.text", "db.statement"}
+	DbNamespaceAttribute              = SemconvAttribute{"db.namespace", "db.name"}
+	DbCollectionAttribute             = SemconvAttribute{"db.collection.name", DbSqlTableAttributeName, "db.mongodb.collection", "db.cassandra.table"}
+	MessagingDestinationNameAttribute = SemconvAttribute{MessagingDestinationNameAttributeName, "messaging.destination"}
+	MessagingDestinationKindAttribute = SemconvAttribute{MessagingDestinationKindAttributeName, "messaging.destination_kind"}
+)
+
+// Get returns the value of the first name of the attribute that is present
+func (attribute SemconvAttribute) Get(attributes pcommon.Map) (pcommon.Value, bool) {
+	for _, name := range attribute {
+		if value, exists := attributes.Get(name); exists {
+			return value, true
+		}
+	}
+	return pcommon.Value{}, false
+}
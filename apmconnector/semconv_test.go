@@ -0,0 +1,135 @@
+package apmconnector
+
+import (
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+	"testing"
+)
+
+// attributes sent by the SDKs of each semantic convention release, for the same requests
+var semconvVersions = []struct {
+	version  string
+	server   map[string]string
+	database map[string]string
+	external map[string]string
+}{
+	{
+		version:  "1.20",
+		server:   map[string]string{"http.method": "GET", "http.target": "/users/12?expand=true", "http.status_code": "200"},
+		database: map[string]string{"db.system": "postgresql", "db.operation": "SELECT", "db.statement": "SELECT * FROM users", "net.peer.name": "db1", "db.name": "shop"},
+		external: map[string]string{"http.method": "GET", "http.url": "https://api.example.com/v1", "net.peer.name": "api.example.com", "net.peer.port": "443"},
+	},
+	{
+		version:  "1.21",
+		server:   map[string]string{"http.method": "GET", "url.path": "/users/12", "http.status_code": "200"},
+		database: map[string]string{"db.system": "postgresql", "db.operation": "SELECT", "db.sql.table": "users", "server.address": "db1", "db.name": "shop"},
+		external: map[string]string{"http.method": "GET", "url.full": "https://api.example.com/v1", "server.address": "api.example.com", "server.port": "443"},
+	},
+	{
+		version:  "1.24",
+		server:   map[string]string{"http.request.method": "GET", "url.path": "/users/12", "http.response.status_code": "200"},
+		database: map[string]string{"db.system": "postgresql", "db.operation": "SELECT", "db.statement": "SELECT * FROM users", "server.address": "db1", "db.name": "shop"},
+		external: map[string]string{"http.request.method": "GET", "url.full": "https://api.example.com/v1", "server.address": "api.example.com", "server.port": "443"},
+	},
+	{
+		version:  "1.26",
+		server:   map[string]string{"http.request.method": "GET", "url.path": "/users/12", "http.response.status_code": "200"},
+		database: map[string]string{"db.system": "postgresql", "db.operation.name": "SELECT", "db.query.text": "SELECT * FROM orders", "db.collection.name": "users", "server.address": "db1", "db.namespace": "shop"},
+		external: map[string]string{"http.request.method": "GET", "url.full": "https://api.example.com/v1", "server.address": "api.example.com", "server.port": "443"},
+	},
+	{
+		version:  "1.30",
+		server:   map[string]string{"http.request.method": "GET", "url.path": "/users/12", "http.response.status_code": "200"},
+		database: map[string]string{"db.system.name": "postgresql", "db.operation.name": "SELECT", "db.query.text": "SELECT * FROM users", "server.address": "db1", "db.namespace": "shop"},
+		external: map[string]string{"http.request.method": "GET", "url.full": "https://api.example.com/v1", "server.address": "api.example.com", "server.port": "443"},
+	},
+}
+
+func putStrs(attributes pcommon.Map, values map[string]string) {
+	for key, value := range values {
+		attributes.PutStr(key, value)
+	}
+}
+
+func TestSemconvVersions(t *testing.T) {
+	namer, _ := NewTransactionNamer([]NamingRuleConfig{{Type: IdSegmentsNamingRule}}, nil)
+	for _, semconv := range semconvVersions {
+		t.Run(semconv.version, func(t *testing.T) {
+			transactions := NewTransactionsMap(0.5, namer, nil, nil)
+			metrics := NewMeterProvider(MetricsConfig{}).getOrCreateResourceMetrics(pcommon.NewMap())
+
+			root := newTimedTestSpan([8]byte{1}, [8]byte{}, ptrace.SpanKindServer, 0, 100)
+			putStrs(root.Attributes(), semconv.server)
+			db := newTimedTestSpan([8]byte{2}, [8]byte{1}, ptrace.SpanKindClient, 10, 20)
+			putStrs(db.Attributes(), semconv.database)
+			external := newTimedTestSpan([8]byte{3}, [8]byte{1}, ptrace.SpanKindClient, 30, 40)
+			putStrs(external.Attributes(), semconv.external)
+
+			spans := []ptrace.Span{root, db, external}
+			for _, span := range spans {
+				transactions.IndexSpan(span, metrics)
+			}
+			for _, span := range spans {
+				transaction, _ := transactions.GetOrCreateTransaction("java", span, metrics)
+				transaction.AddSpan(span, pcommon.NewInstrumentationScope())
+			}
+			transactions.ProcessTransactions()
+
+			name, _ := namer.GetTransactionMetricName(root, pcommon.NewInstrumentationScope())
+			assert.Equal(t, "WebTransaction/Uri/users/* (GET)", name)
+
+			for _, transaction := range transactions.Transactions {
+				dbMeasurement := transaction.Measurements[db.SpanID().String()]
+				assert.Equal(t, "Datastore/statement/postgresql/users/SELECT", dbMeasurement.MetricTimesliceName)
+				peer, _ := dbMeasurement.Attributes.Get("net.peer.name")
+				assert.Equal(t, "db1", peer.AsString())
+				dbName, _ := dbMeasurement.Attributes.Get("db.name")
+				assert.Equal(t, "shop", dbName.AsString())
+				assert.Equal(t, "External/api.example.com/http/GET", transaction.Measurements[external.SpanID().String()].MetricTimesliceName)
+			}
+
+			logs := BuildTransactions(namer, nil, 0.5, LogsOutputTransactions, nil, newSingleSpanTraces(root))
+			logName, _ := logs.ResourceLogs().At(0).ScopeLogs().At(0).LogRecords().At(0).Attributes().Get("name")
+			assert.Equal(t, "WebTransaction/Uri/users/* (GET)", logName.AsString())
+
+			statusCode, _ := HttpResponseStatusCodeAttribute.Get(root.Attributes())
+			assert.Equal(t, "200", statusCode.AsString())
+			url, _ := UrlFullAttribute.Get(external.Attributes())
+			assert.Equal(t, "https://api.example.com/v1", url.AsString())
+			port, _ := ServerPortAttribute.Get(external.Attributes())
+			assert.Equal(t, "443", port.AsString())
+		})
+	}
+}
+
+func newSingleSpanTraces(span ptrace.Span) ptrace.Traces {
+	traces := ptrace.NewTraces()
+	span.CopyTo(traces.ResourceSpans().AppendEmpty().ScopeSpans().AppendEmpty().Spans().AppendEmpty())
+	return traces
+}
+
+func TestSemconvAttributePrecedence(t *testing.T) {
+	attributes := pcommon.NewMap()
+	_, exists := HttpRequestMethodAttribute.Get(attributes)
+	assert.False(t, exists)
+
+	attributes.PutStr("http.method", "GET")
+	method, _ := HttpRequestMethodAttribute.Get(attributes)
+	assert.Equal(t, "GET", method.AsString())
+
+	// the most recent name wins when an SDK sends both during a migration
+	attributes.PutStr("http.request.method", "POST")
+	method, _ = HttpRequestMethodAttribute.Get(attributes)
+	assert.Equal(t, "POST", method.AsString())
+}
+
+func TestSemconvMessagingDestination(t *testing.T) {
+	span := ptrace.NewSpan()
+	span.Attributes().PutStr("messaging.destination", "orders")
+	span.Attributes().PutStr("messaging.destination_kind", "topic")
+
+	kind, name := GetMessagingDestination(span, "rabbitmq")
+	assert.Equal(t, "Topic", kind)
+	assert.Equal(t, "orders", name)
+}
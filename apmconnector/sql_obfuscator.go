@@ -0,0 +1,142 @@
+package apmconnector
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+
+	"go.opentelemetry.io/collector/pdata/ptrace"
+)
+
+type SqlObfuscationMode string
+
+const (
+	// SqlObfuscationOff sends the statements as they are
+	SqlObfuscationOff SqlObfuscationMode = "off"
+	// SqlObfuscationObfuscate replaces the literals of the statements with ?
+	SqlObfuscationObfuscate SqlObfuscationMode = "obfuscate"
+	// SqlObfuscationDrop removes the statements, only their hash is kept
+	SqlObfuscationDrop SqlObfuscationMode = "drop"
+)
+
+const DbStatementHashAttributeName = "db.statement.hash"
+
+// ObfuscateSql replaces the string and numeric literals of a statement with ? and collapses
+// the IN lists to IN (?). Comments are removed and whitespace is collapsed.
+func ObfuscateSql(sql string, dbSystem string) string {
+	return obfuscateSqlTokens(tokenizeSql(sql, GetSqlDialect(dbSystem)), false)
+}
+
+// HashSql returns a hash of the obfuscated statement with its unquoted words lower cased,
+// the same query with other literals or another formatting has the same hash
+func HashSql(sql string, dbSystem string) string {
+	hash := fnv.New64a()
+	hash.Write([]byte(obfuscateSqlTokens(tokenizeSql(sql, GetSqlDialect(dbSystem)), true)))
+	return fmt.Sprintf("%016x", hash.Sum64())
+}
+
+func obfuscateSqlTokens(tokens []sqlToken, normalize bool) string {
+	var builder strings.Builder
+	closing := matchingParentheses(tokens)
+	for i := 0; i < len(tokens); i++ {
+		token := tokens[i]
+		if i > 0 && token.start > tokens[i-1].end {
+			builder.WriteByte(' ')
+		}
+		switch {
+		case token.isWord("IN") && i+1 < len(tokens) && tokens[i+1].isPunctuation("(") && isSqlValueList(tokens, i+1, closing[i+1]):
+			writeSqlWord(&builder, token.text, normalize)
+			if tokens[i+1].start > token.end {
+				builder.WriteByte(' ')
+			}
+			builder.WriteString("(?)")
+			i = closing[i+1]
+		case token.kind == sqlString || token.kind == sqlNumber:
+			builder.WriteByte('?')
+		case token.kind == sqlWord:
+			writeSqlWord(&builder, token.text, normalize)
+		default:
+			builder.WriteString(token.text)
+		}
+	}
+	return builder.String()
+}
+
+func writeSqlWord(builder *strings.Builder, word string, normalize bool) {
+	if normalize {
+		word = strings.ToLower(word)
+	}
+	builder.WriteString(word)
+}
+
+// matchingParentheses returns the index of the parenthesis closing each opening parenthesis,
+// len(tokens) when it is not closed. The statement is scanned once, rescanning it from every
+// parenthesis would be quadratic.
+func matchingParentheses(tokens []sqlToken) []int {
+	closing := make([]int, len(tokens))
+	var opened []int
+	for i, token := range tokens {
+		switch {
+		case token.isPunctuation("("):
+			closing[i] = len(tokens)
+			opened = append(opened, i)
+		case token.isPunctuation(")") && len(opened) > 0:
+			closing[opened[len(opened)-1]] = i
+			opened = opened[:len(opened)-1]
+		}
+	}
+	return closing
+}
+
+// isSqlValueList returns true when the parenthesis at open, closed at end, only contains literals and bind parameters
+func isSqlValueList(tokens []sqlToken, open int, end int) bool {
+	if end >= len(tokens) || end == open+1 {
+		return false
+	}
+	for _, token := range tokens[open+1 : end] {
+		switch {
+		case token.kind == sqlString, token.kind == sqlNumber, token.isPunctuation(","):
+		case token.kind == sqlOther && token.text != "" && strings.ContainsAny(token.text[:1], "?$:-"):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// ObfuscateSpanStatement replaces or removes the statement of a database span, and adds the hash of the statement.
+// The statements of the non SQL systems cannot be tokenized, they are removed without a hash.
+func ObfuscateSpanStatement(span ptrace.Span, mode SqlObfuscationMode) {
+	if mode == "" || mode == SqlObfuscationOff {
+		return
+	}
+	statement, statementPresent := DbQueryTextAttribute.Get(span.Attributes())
+	if !statementPresent {
+		return
+	}
+	dbSystem := ""
+	if value, exists := DbSystemAttribute.Get(span.Attributes()); exists {
+		dbSystem = value.AsString()
+	}
+	sql := statement.AsString()
+	// update the statement before adding attributes, which can move the values of the map
+	if nonSqlDbSystems[dbSystem] {
+		for _, name := range DbQueryTextAttribute {
+			span.Attributes().Remove(name)
+		}
+		return
+	}
+	if mode == SqlObfuscationDrop {
+		for _, name := range DbQueryTextAttribute {
+			span.Attributes().Remove(name)
+		}
+	} else {
+		// a span can have both the old and the new attribute during the semconv migration
+		for _, name := range DbQueryTextAttribute {
+			if value, exists := span.Attributes().Get(name); exists {
+				value.SetStr(ObfuscateSql(value.AsString(), dbSystem))
+			}
+		}
+	}
+	span.Attributes().PutStr(DbStatementHashAttributeName, HashSql(sql, dbSystem))
+}
@@ -0,0 +1,106 @@
+package apmconnector
+
+import (
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+	"strings"
+	"testing"
+)
+
+func TestObfuscateSql(t *testing.T) {
+	tests := []struct {
+		dbSystem, sql, obfuscated string
+	}{
+		{"postgresql", "SELECT * FROM users WHERE email = 'jane@example.com' AND age > 42", "SELECT * FROM users WHERE email = ? AND age > ?"},
+		{"postgresql", `SELECT "Email" FROM "Users" WHERE token = $$secret$$ AND id = $1`, `SELECT "Email" FROM "Users" WHERE token = ? AND id = $1`},
+		{"postgresql", "SELECT * FROM t WHERE s = E'it\\'s' AND n = -1.5e10", "SELECT * FROM t WHERE s = ? AND n = -?"},
+		{"mysql", `SELECT * FROM users WHERE email = "jane@example.com" AND note = 'it\'s'`, "SELECT * FROM users WHERE email = ? AND note = ?"},
+		{"mysql", "SELECT * FROM `users` WHERE id IN (1, 2, 3) AND name IN (?, ?)", "SELECT * FROM `users` WHERE id IN (?) AND name IN (?)"},
+		{"mysql", "SELECT * FROM users WHERE id IN (SELECT user_id FROM bans)", "SELECT * FROM users WHERE id IN (SELECT user_id FROM bans)"},
+		{"mssql", "UPDATE [Customers] SET name = N'Jane' /* from app */ WHERE id = 7", "UPDATE [Customers] SET name = ? WHERE id = ?"},
+		{"oracle", "SELECT * FROM hr.employees -- name = 'x'\nWHERE name = 'O''Brien'", "SELECT * FROM hr.employees WHERE name = ?"},
+		{"mysql", "SELECT * FROM t WHERE (a IN (1, 2)) AND b IN ((SELECT c FROM d), 3) AND e IN (4", "SELECT * FROM t WHERE (a IN (?)) AND b IN ((SELECT c FROM d), ?) AND e IN (?"},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.obfuscated, ObfuscateSql(test.sql, test.dbSystem), test.sql)
+	}
+}
+
+func TestObfuscateUnclosedParentheses(t *testing.T) {
+	// every parenthesis used to rescan the rest of the statement
+	sql := strings.Repeat("x IN (", 200000)
+	assert.Equal(t, strings.TrimSpace(sql), ObfuscateSql(sql, "mysql"))
+}
+
+func TestHashSql(t *testing.T) {
+	hash := HashSql("SELECT * FROM users WHERE id = 1", "postgresql")
+	assert.Equal(t, hash, HashSql("select *\n  from users where id = 42 -- by id", "postgresql"))
+	assert.Equal(t, HashSql("SELECT * FROM t WHERE id IN (1)", "mysql"), HashSql("SELECT * FROM t WHERE id IN (1, 2, 3)", "mysql"))
+	assert.NotEqual(t, hash, HashSql("SELECT * FROM users WHERE name = 'x'", "postgresql"))
+	// a double quoted name is an identifier for PostgreSQL, and a string for MySQL
+	assert.NotEqual(t, HashSql(`SELECT "a" FROM t`, "postgresql"), HashSql(`SELECT "b" FROM t`, "postgresql"))
+	assert.Equal(t, HashSql(`SELECT "a" FROM t`, "mysql"), HashSql(`SELECT "b" FROM t`, "mysql"))
+}
+
+func TestObfuscateSpanStatement(t *testing.T) {
+	newSpan := func() ptrace.Span {
+		span := ptrace.NewSpan()
+		span.Attributes().PutStr("db.system", "postgresql")
+		span.Attributes().PutStr("db.statement", "SELECT * FROM users WHERE email = 'jane@example.com'")
+		return span
+	}
+
+	span := newSpan()
+	ObfuscateSpanStatement(span, SqlObfuscationOff)
+	statement, _ := span.Attributes().Get("db.statement")
+	assert.Equal(t, "SELECT * FROM users WHERE email = 'jane@example.com'", statement.Str())
+	_, hashPresent := span.Attributes().Get(DbStatementHashAttributeName)
+	assert.False(t, hashPresent)
+
+	span = newSpan()
+	ObfuscateSpanStatement(span, SqlObfuscationObfuscate)
+	statement, _ = span.Attributes().Get("db.statement")
+	assert.Equal(t, "SELECT * FROM users WHERE email = ?", statement.Str())
+	hash, _ := span.Attributes().Get(DbStatementHashAttributeName)
+	assert.Equal(t, HashSql("SELECT * FROM users WHERE email = ?", "postgresql"), hash.Str())
+
+	span = newSpan()
+	ObfuscateSpanStatement(span, SqlObfuscationDrop)
+	_, statementPresent := span.Attributes().Get("db.statement")
+	assert.False(t, statementPresent)
+	_, hashPresent = span.Attributes().Get(DbStatementHashAttributeName)
+	assert.True(t, hashPresent)
+}
+
+func TestObfuscateSpanStatementAliases(t *testing.T) {
+	span := ptrace.NewSpan()
+	span.Attributes().PutStr("db.system", "postgresql")
+	span.Attributes().PutStr("db.query.text", "SELECT * FROM users WHERE email = 'jane@example.com'")
+	span.Attributes().PutStr("db.statement", "SELECT * FROM users WHERE email = 'jane@example.com'")
+
+	ObfuscateSpanStatement(span, SqlObfuscationObfuscate)
+	for _, name := range []string{"db.query.text", "db.statement"} {
+		statement, _ := span.Attributes().Get(name)
+		assert.Equal(t, "SELECT * FROM users WHERE email = ?", statement.Str(), name)
+	}
+}
+
+func TestObfuscateNonSqlSpanStatement(t *testing.T) {
+	for dbSystem, statement := range map[string]string{
+		"mongodb":       `{"find":"users","filter":{"name":"bob"}}`,
+		"elasticsearch": `{"query":{"match":{"email":"jane@example.com"}}}`,
+	} {
+		for _, mode := range []SqlObfuscationMode{SqlObfuscationObfuscate, SqlObfuscationDrop} {
+			span := ptrace.NewSpan()
+			span.Attributes().PutStr("db.system", dbSystem)
+			span.Attributes().PutStr("db.statement", statement)
+			span.Attributes().PutStr("db.query.text", statement)
+
+			ObfuscateSpanStatement(span, mode)
+			for _, name := range []string{"db.statement", "db.query.text", DbStatementHashAttributeName} {
+				_, present := span.Attributes().Get(name)
+				assert.False(t, present, dbSystem+" "+name)
+			}
+		}
+	}
+}
@@ -1,40 +1,241 @@
 package apmconnector
 
 import (
-	"regexp"
 	"strings"
 
 	"go.opentelemetry.io/collector/pdata/ptrace"
 )
 
+// SqlStatement is the operation of a SQL statement and the table it is run on
+type SqlStatement struct {
+	// in upper case, SELECT, INSERT...
+	Operation string
+	// the table name, unquoted and with its schema when it is qualified. Unquoted names are lower cased.
+	Table string
+}
+
+// the words that can be between the operation and the table name
+var (
+	insertModifiers = []string{"INTO", "IGNORE", "LOW_PRIORITY", "DELAYED", "HIGH_PRIORITY", "OR", "REPLACE", "ROLLBACK", "ABORT", "FAIL", "TOP"}
+	updateModifiers = []string{"LOW_PRIORITY", "IGNORE", "ONLY", "OR", "REPLACE", "ROLLBACK", "ABORT", "FAIL", "TOP"}
+	deleteModifiers = []string{"LOW_PRIORITY", "QUICK", "IGNORE", "ONLY", "TOP"}
+	mergeModifiers  = []string{"INTO", "TOP"}
+	ddlModifiers    = []string{"OR", "REPLACE", "TEMPORARY", "TEMP", "GLOBAL", "LOCAL", "UNIQUE", "UNLOGGED", "MATERIALIZED",
+		"TABLE", "VIEW", "INDEX", "SEQUENCE", "PROCEDURE", "FUNCTION", "TRIGGER", "IF", "NOT", "EXISTS", "CONCURRENTLY"}
+	fromModifiers = []string{"ONLY", "LATERAL"}
+	// words that end the search for a table name
+	notTableNames = []string{"SELECT", "SET", "WHERE", "VALUES", "VALUE", "DEFAULT", "ON", "USING", "AS"}
+)
+
 type SqlParser struct {
-	re *regexp.Regexp
 }
 
 func NewSqlParser() *SqlParser {
-	re, _ := regexp.Compile(`(?i).*?\sfrom[\s\[]+([^\]\s,)(;]*).*`)
-	return &SqlParser{re: re}
+	return &SqlParser{}
 }
 
-func (sqlParser *SqlParser) ParseDbTableFromSql(sql string) (string, bool) {
-	matches := sqlParser.re.FindStringSubmatch(sql)
-	count := len(matches)
-	if count < 2 {
-		return "", false
+// ParseSql analyzes a statement in the dialect of dbSystem. When there are several statements,
+// the first one with a table is returned. It returns false when no operation was found.
+func (sqlParser *SqlParser) ParseSql(sql string, dbSystem string) (SqlStatement, bool) {
+	tokens := tokenizeSql(sql, GetSqlDialect(dbSystem))
+	var parsed SqlStatement
+	for start := 0; start < len(tokens); {
+		end := start
+		for end < len(tokens) && !(tokens[end].isPunctuation(";") && tokens[end].depth == 0) {
+			end++
+		}
+		statement := analyzeSqlStatement(tokens[start:end])
+		if statement.Table != "" {
+			return statement, true
+		}
+		if parsed.Operation == "" {
+			parsed = statement
+		}
+		start = end + 1
 	}
-	return strings.ToLower(matches[1]), true
+	return parsed, parsed.Operation != ""
 }
 
+func (sqlParser *SqlParser) ParseDbTableFromSql(sql string) (string, bool) {
+	statement, _ := sqlParser.ParseSql(sql, "")
+	return statement.Table, statement.Table != ""
+}
+
+// ParseDbTableFromSpan returns the table of a database span, and true when it was parsed from the statement
 func (sqlParser *SqlParser) ParseDbTableFromSpan(span ptrace.Span) (string, bool) {
-	dbTable, dbTablePresent := span.Attributes().Get(DbSqlTableAttributeName)
+	dbTable, dbTablePresent := DbCollectionAttribute.Get(span.Attributes())
 	if dbTablePresent {
 		return dbTable.AsString(), false
 	} else {
-		if sql, sqlPresent := span.Attributes().Get("db.statement"); sqlPresent {
-			if parsedTable, exists := sqlParser.ParseDbTableFromSql(sql.AsString()); exists {
-				return parsedTable, true
-			}
+		if statement, parsed := sqlParser.ParseSpanStatement(span); parsed && statement.Table != "" {
+			return statement.Table, true
 		}
 	}
 	return "unknown", false
 }
+
+// ParseSpanStatement analyzes the statement of a database span
+func (sqlParser *SqlParser) ParseSpanStatement(span ptrace.Span) (SqlStatement, bool) {
+	sql, sqlPresent := DbQueryTextAttribute.Get(span.Attributes())
+	if !sqlPresent {
+		return SqlStatement{}, false
+	}
+	dbSystem := ""
+	if value, exists := DbSystemAttribute.Get(span.Attributes()); exists {
+		dbSystem = value.AsString()
+	}
+	return sqlParser.ParseSql(sql.AsString(), dbSystem)
+}
+
+func analyzeSqlStatement(tokens []sqlToken) SqlStatement {
+	i := 0
+	// (SELECT ...) UNION (SELECT ...)
+	for i < len(tokens) && tokens[i].isPunctuation("(") {
+		i++
+	}
+	ctes := make(map[string]SqlStatement)
+	if i < len(tokens) && tokens[i].isWord("WITH") {
+		i = parseCtes(tokens, i+1, ctes)
+	}
+	if i >= len(tokens) || tokens[i].kind != sqlWord {
+		return SqlStatement{}
+	}
+
+	statement := SqlStatement{Operation: strings.ToUpper(tokens[i].text)}
+	depth := tokens[i].depth
+	switch statement.Operation {
+	case "SELECT":
+		statement.Table = tableAfter(tokens, i+1, depth, "FROM")
+	case "INSERT", "REPLACE":
+		statement.Table = tableAfter(tokens, i+1, depth, "INTO")
+		if statement.Table == "" {
+			statement.Table, _ = parseTableName(tokens, i+1, insertModifiers)
+		}
+	case "UPDATE":
+		statement.Table, _ = parseTableName(tokens, i+1, updateModifiers)
+	case "DELETE":
+		// MySQL and MSSQL: DELETE alias FROM users alias
+		statement.Table = tableAfter(tokens, i+1, depth, "FROM")
+		if statement.Table == "" {
+			statement.Table, _ = parseTableName(tokens, i+1, deleteModifiers)
+		}
+	case "MERGE":
+		statement.Table, _ = parseTableName(tokens, i+1, mergeModifiers)
+	case "CREATE", "DROP", "ALTER", "TRUNCATE":
+		statement.Table, _ = parseTableName(tokens, i+1, ddlModifiers)
+	case "CALL", "EXEC", "EXECUTE":
+		statement.Table, _ = parseTableName(tokens, i+1, nil)
+	}
+	if cte, isCte := ctes[statement.Table]; isCte {
+		statement.Table = cte.Table
+	}
+	return statement
+}
+
+// parseCtes parses WITH [RECURSIVE] name [(columns)] AS [[NOT] MATERIALIZED] (statement), ...
+// and returns the index of the main statement
+func parseCtes(tokens []sqlToken, i int, ctes map[string]SqlStatement) int {
+	if i < len(tokens) && tokens[i].isWord("RECURSIVE") {
+		i++
+	}
+	for i < len(tokens) {
+		name, next := parseName(tokens, i)
+		if name == "" {
+			return i
+		}
+		i = next
+		if i < len(tokens) && tokens[i].isPunctuation("(") {
+			i = closingParenthesis(tokens, i) + 1
+		}
+		for i < len(tokens) && tokens[i].isWord("AS", "NOT", "MATERIALIZED") {
+			i++
+		}
+		if i >= len(tokens) || !tokens[i].isPunctuation("(") {
+			return i
+		}
+		end := closingParenthesis(tokens, i)
+		ctes[name] = analyzeSqlStatement(tokens[i+1 : end])
+		i = end + 1
+		if i >= len(tokens) || !tokens[i].isPunctuation(",") {
+			return i
+		}
+		i++
+	}
+	return i
+}
+
+// tableAfter returns the table following the first keyword at depth, the table of the
+// subquery when it is followed by one
+func tableAfter(tokens []sqlToken, i int, depth int, keyword string) string {
+	for ; i < len(tokens); i++ {
+		if tokens[i].depth == depth && tokens[i].isWord(keyword) {
+			break
+		}
+	}
+	i++
+	for i < len(tokens) && tokens[i].isWord(fromModifiers...) {
+		i++
+	}
+	if i < len(tokens) && tokens[i].isPunctuation("(") {
+		return analyzeSqlStatement(tokens[i+1 : closingParenthesis(tokens, i)]).Table
+	}
+	name, _ := parseName(tokens, i)
+	return name
+}
+
+// parseTableName skips the modifiers before the table name, and parses it
+func parseTableName(tokens []sqlToken, i int, modifiers []string) (string, int) {
+	for i < len(tokens) {
+		if tokens[i].isWord("TOP") && i+1 < len(tokens) && tokens[i+1].isPunctuation("(") {
+			// MSSQL: UPDATE TOP (10) users
+			i = closingParenthesis(tokens, i+1) + 1
+		} else if tokens[i].isWord(modifiers...) || tokens[i].kind == sqlNumber {
+			i++
+		} else {
+			break
+		}
+	}
+	return parseName(tokens, i)
+}
+
+// parseName parses a possibly qualified and quoted name, schema.table
+func parseName(tokens []sqlToken, i int) (string, int) {
+	var parts []string
+	for i < len(tokens) {
+		token := tokens[i]
+		if token.kind == sqlQuotedIdentifier {
+			parts = append(parts, unquoteSqlIdentifier(token.text))
+		} else if token.kind == sqlWord && !token.isWord(notTableNames...) {
+			parts = append(parts, strings.ToLower(token.text))
+		} else {
+			break
+		}
+		i++
+		if i+1 >= len(tokens) || !tokens[i].isPunctuation(".") {
+			break
+		}
+		i++
+	}
+	return strings.Join(parts, "."), i
+}
+
+func unquoteSqlIdentifier(identifier string) string {
+	if len(identifier) < 2 {
+		return identifier
+	}
+	quote := identifier[:1]
+	if quote == "[" {
+		return identifier[1 : len(identifier)-1]
+	}
+	return strings.ReplaceAll(identifier[1:len(identifier)-1], quote+quote, quote)
+}
+
+// closingParenthesis returns the index of the parenthesis closing the one at open
+func closingParenthesis(tokens []sqlToken, open int) int {
+	for i := open + 1; i < len(tokens); i++ {
+		if tokens[i].depth == tokens[open].depth && tokens[i].isPunctuation(")") {
+			return i
+		}
+	}
+	return len(tokens)
+}
@@ -2,6 +2,8 @@ package apmconnector
 
 import (
 	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/ptrace"
 	"testing"
 )
 
@@ -16,3 +18,69 @@ func TestParseDbTableFromSqlJoin(t *testing.T) {
 	assert.Equal(t, true, exists)
 	assert.Equal(t, "users", table)
 }
+
+func TestParseSql(t *testing.T) {
+	tests := []struct {
+		dbSystem, sql, operation, table string
+	}{
+		{"postgresql", "SELECT * FROM users WHERE id = $1", "SELECT", "users"},
+		{"postgresql", `select * from "public"."Users"`, "SELECT", "public.Users"},
+		{"postgresql", "SELECT * FROM ONLY accounts", "SELECT", "accounts"},
+		{"postgresql", "SELECT $$ from x $$, name FROM items", "SELECT", "items"},
+		{"postgresql", "WITH recent AS (SELECT * FROM orders WHERE created > now()) SELECT * FROM recent", "SELECT", "orders"},
+		{"postgresql", "WITH RECURSIVE tree(id) AS (SELECT id FROM nodes) , x AS NOT MATERIALIZED (SELECT 1) INSERT INTO paths SELECT * FROM tree", "INSERT", "paths"},
+		{"postgresql", "SELECT * FROM (SELECT * FROM invoices) AS i", "SELECT", "invoices"},
+		{"postgresql", "SELECT (SELECT max(id) FROM a), extract(year from d) FROM b", "SELECT", "b"},
+		{"postgresql", "(SELECT id FROM a) UNION (SELECT id FROM b)", "SELECT", "a"},
+		{"postgresql", "UPDATE ONLY accounts SET balance = 0", "UPDATE", "accounts"},
+		{"mysql", "INSERT IGNORE INTO `shop`.`orders` (id) VALUES (1)", "INSERT", "shop.orders"},
+		{"mysql", `SELECT "from users" FROM carts`, "SELECT", "carts"},
+		{"mysql", `SELECT 'it\'s from users' FROM carts`, "SELECT", "carts"},
+		{"mysql", "# comment\nDELETE LOW_PRIORITY FROM sessions WHERE expired", "DELETE", "sessions"},
+		{"mysql", "REPLACE INTO settings VALUES (1, 'a')", "REPLACE", "settings"},
+		{"mysql", "DELETE s FROM sessions s JOIN users u ON s.user_id = u.id", "DELETE", "sessions"},
+		{"mssql", "SELECT TOP 10 * FROM [dbo].[Customers]", "SELECT", "dbo.Customers"},
+		{"mssql", "UPDATE TOP (10) Customers SET name = N'from x'", "UPDATE", "customers"},
+		{"mssql", "INSERT Customers VALUES (1)", "INSERT", "customers"},
+		{"mssql", "DELETE Customers WHERE id IN (SELECT id FROM banned)", "DELETE", "customers"},
+		{"mssql", "SELECT * FROM #temp", "SELECT", "#temp"},
+		{"mssql", "MERGE INTO Inventory AS t USING Orders AS s ON t.id = s.id WHEN MATCHED THEN DELETE;", "MERGE", "inventory"},
+		{"mssql", "SET NOCOUNT ON; EXEC dbo.GetCustomers @id = 1", "EXEC", "dbo.getcustomers"},
+		{"oracle", "select * from HR.EMPLOYEES where name = 'O''Brien'", "SELECT", "hr.employees"},
+		{"oracle", "MERGE INTO bonuses b USING employees e ON (b.id = e.id)", "MERGE", "bonuses"},
+		{"sqlite", "INSERT OR REPLACE INTO [kv] (k, v) VALUES (?, ?)", "INSERT", "kv"},
+		{"sqlite", "CREATE TABLE IF NOT EXISTS notes (id INTEGER)", "CREATE", "notes"},
+		{"", "/* from comments */ select * -- from line\n from products", "SELECT", "products"},
+		{"", "BEGIN; UPDATE stock SET n = n - 1; COMMIT", "UPDATE", "stock"},
+		{"", "SELECT 1", "SELECT", ""},
+	}
+	for _, test := range tests {
+		statement, parsed := NewSqlParser().ParseSql(test.sql, test.dbSystem)
+		assert.True(t, parsed, test.sql)
+		assert.Equal(t, SqlStatement{Operation: test.operation, Table: test.table}, statement, test.sql)
+	}
+
+	_, parsed := NewSqlParser().ParseSql(`{"find": "users"}`, "mongodb")
+	assert.False(t, parsed)
+}
+
+func TestInferDbOperation(t *testing.T) {
+	transactions := NewTransactionsMap(0.5, &TransactionNamer{}, nil, nil)
+	metrics := NewMeterProvider(MetricsConfig{}).getOrCreateResourceMetrics(pcommon.NewMap())
+
+	root := newTimedTestSpan([8]byte{1}, [8]byte{}, ptrace.SpanKindServer, 0, 100)
+	db := newTimedTestSpan([8]byte{2}, [8]byte{1}, ptrace.SpanKindClient, 10, 20)
+	db.Attributes().PutStr("db.system", "mysql")
+	db.Attributes().PutStr("db.statement", "insert into `orders` (id) values (?)")
+
+	for _, span := range []ptrace.Span{root, db} {
+		transactions.IndexSpan(span, metrics)
+	}
+	for _, span := range []ptrace.Span{root, db} {
+		transaction, _ := transactions.GetOrCreateTransaction("java", span, metrics)
+		transaction.AddSpan(span, pcommon.NewInstrumentationScope())
+	}
+	for _, transaction := range transactions.Transactions {
+		assert.Equal(t, "Datastore/statement/mysql/orders/INSERT", transaction.Measurements[db.SpanID().String()].MetricTimesliceName)
+	}
+}
@@ -0,0 +1,227 @@
+package apmconnector
+
+import (
+	"strings"
+)
+
+type sqlTokenKind int
+
+const (
+	// keywords and unquoted identifiers
+	sqlWord sqlTokenKind = iota
+	// "name", `name` or [name]
+	sqlQuotedIdentifier
+	sqlString
+	sqlNumber
+	// ( ) , ; .
+	sqlPunctuation
+	// operators and bind parameters
+	sqlOther
+)
+
+type sqlToken struct {
+	kind sqlTokenKind
+	text string
+	// offsets of the token in the statement
+	start, end int
+	// number of parentheses the token is in, a parenthesis has the depth of its outside
+	depth int
+}
+
+func (token sqlToken) isWord(words ...string) bool {
+	if token.kind != sqlWord {
+		return false
+	}
+	for _, word := range words {
+		if strings.EqualFold(token.text, word) {
+			return true
+		}
+	}
+	return false
+}
+
+func (token sqlToken) isPunctuation(punctuation string) bool {
+	return token.kind == sqlPunctuation && token.text == punctuation
+}
+
+// SqlDialect is the syntax of the strings and quoted identifiers of a database
+type SqlDialect struct {
+	// MySQL quotes strings with double quotes
+	doubleQuotedStrings bool
+	// MySQL escapes quotes in strings with a backslash
+	backslashEscapes bool
+	// MSSQL and SQLite quote identifiers with brackets
+	bracketIdentifiers bool
+	// PostgreSQL quotes strings with $tag$...$tag$
+	dollarQuotedStrings bool
+}
+
+// GetSqlDialect returns the dialect of a db.system, unknown systems accept most of the syntaxes
+func GetSqlDialect(dbSystem string) SqlDialect {
+	switch dbSystem {
+	case "mysql", "mariadb":
+		return SqlDialect{doubleQuotedStrings: true, backslashEscapes: true}
+	case "postgresql", "cockroachdb", "redshift":
+		return SqlDialect{dollarQuotedStrings: true}
+	case "mssql", "microsoft.sql_server", "sqlite":
+		return SqlDialect{bracketIdentifiers: true}
+	case "oracle", "db2":
+		return SqlDialect{}
+	default:
+		return SqlDialect{bracketIdentifiers: true, dollarQuotedStrings: true}
+	}
+}
+
+// tokenizeSql splits a statement into tokens, comments are dropped
+func tokenizeSql(sql string, dialect SqlDialect) []sqlToken {
+	var tokens []sqlToken
+	depth := 0
+	add := func(kind sqlTokenKind, start, end int) {
+		tokens = append(tokens, sqlToken{kind: kind, text: sql[start:end], start: start, end: end, depth: depth})
+	}
+
+	for i := 0; i < len(sql); {
+		c := sql[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f':
+			i++
+		case strings.HasPrefix(sql[i:], "--"), c == '#' && (i+1 == len(sql) || isSqlSpace(sql[i+1])):
+			// MySQL also starts line comments with "# ", #name is a MSSQL temporary table
+			i = indexFrom(sql, i, "\n", len(sql))
+		case strings.HasPrefix(sql[i:], "/*"):
+			i = indexFrom(sql, i+2, "*/", len(sql)-2) + 2
+		case c == '\'':
+			end := scanQuoted(sql, i, '\'', dialect.backslashEscapes)
+			add(sqlString, i, end)
+			i = end
+		case c == '"' && dialect.doubleQuotedStrings:
+			end := scanQuoted(sql, i, '"', dialect.backslashEscapes)
+			add(sqlString, i, end)
+			i = end
+		case c == '"':
+			end := scanQuoted(sql, i, '"', false)
+			add(sqlQuotedIdentifier, i, end)
+			i = end
+		case c == '`':
+			end := scanQuoted(sql, i, '`', false)
+			add(sqlQuotedIdentifier, i, end)
+			i = end
+		case c == '[' && dialect.bracketIdentifiers:
+			end := indexFrom(sql, i, "]", len(sql)-1) + 1
+			add(sqlQuotedIdentifier, i, end)
+			i = end
+		case c == '$' && dialect.dollarQuotedStrings && isDollarQuote(sql[i:]):
+			tag := sql[i : strings.IndexByte(sql[i+1:], '$')+i+2]
+			end := indexFrom(sql, i+len(tag), tag, len(sql)-len(tag)) + len(tag)
+			add(sqlString, i, end)
+			i = end
+		case isSqlDigit(c) || c == '.' && i+1 < len(sql) && isSqlDigit(sql[i+1]):
+			end := i + 1
+			for end < len(sql) && (isSqlWordChar(sql[end]) || sql[end] == '.' ||
+				(sql[end] == '+' || sql[end] == '-') && (sql[end-1] == 'e' || sql[end-1] == 'E')) {
+				end++
+			}
+			add(sqlNumber, i, end)
+			i = end
+		case isSqlWordChar(c) && c != '$' || c == '#' || c == '@':
+			end := i + 1
+			for end < len(sql) && (isSqlWordChar(sql[end]) || sql[end] == '#' || sql[end] == '@') {
+				end++
+			}
+			// N'...', E'...', X'...' and B'...' are strings with a prefix
+			if end == i+1 && end < len(sql) && sql[end] == '\'' && strings.ContainsRune("nNeExXbB", rune(c)) {
+				end = scanQuoted(sql, end, '\'', dialect.backslashEscapes || c == 'e' || c == 'E')
+				add(sqlString, i, end)
+			} else {
+				add(sqlWord, i, end)
+			}
+			i = end
+		case c == '(':
+			add(sqlPunctuation, i, i+1)
+			depth++
+			i++
+		case c == ')':
+			if depth > 0 {
+				depth--
+			}
+			add(sqlPunctuation, i, i+1)
+			i++
+		case c == ',' || c == ';' || c == '.':
+			add(sqlPunctuation, i, i+1)
+			i++
+		case c == '?' || c == '$' || c == ':':
+			// bind parameters: ?, ?1, $1, :name
+			end := i + 1
+			for end < len(sql) && isSqlWordChar(sql[end]) {
+				end++
+			}
+			add(sqlOther, i, end)
+			i = end
+		default:
+			add(sqlOther, i, i+1)
+			i++
+		}
+	}
+	return tokens
+}
+
+// scanQuoted returns the end of the quoted text starting at start, a doubled quote is an escaped quote
+func scanQuoted(sql string, start int, quote byte, backslashEscapes bool) int {
+	for i := start + 1; i < len(sql); i++ {
+		switch sql[i] {
+		case '\\':
+			if backslashEscapes {
+				i++
+			}
+		case quote:
+			if i+1 < len(sql) && sql[i+1] == quote {
+				i++
+				continue
+			}
+			return i + 1
+		}
+	}
+	// unterminated, likely a truncated statement
+	return len(sql)
+}
+
+// indexFrom returns the index of substr after from, or notFound
+func indexFrom(s string, from int, substr string, notFound int) int {
+	if from > len(s) {
+		return notFound
+	}
+	if i := strings.Index(s[from:], substr); i >= 0 {
+		return from + i
+	}
+	return notFound
+}
+
+func isDollarQuote(s string) bool {
+	end := strings.IndexByte(s[1:], '$')
+	if end < 0 {
+		return false
+	}
+	tag := s[1 : end+1]
+	if tag != "" && isSqlDigit(tag[0]) {
+		// $1 is a bind parameter
+		return false
+	}
+	for i := 0; i < len(tag); i++ {
+		if !isSqlWordChar(tag[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func isSqlSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+func isSqlDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isSqlWordChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || isSqlDigit(c) || c == '_' || c == '$' || c >= 0x80
+}
@@ -0,0 +1,138 @@
+package apmconnector
+
+import (
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+	"go.uber.org/zap"
+)
+
+type EvictionPolicy string
+
+const (
+	// EvictionPolicyProcess converts an evicted trace with whatever spans have been seen so far
+	EvictionPolicyProcess EvictionPolicy = "process"
+	// EvictionPolicyDrop discards an evicted trace without producing any metrics
+	EvictionPolicyDrop EvictionPolicy = "drop"
+)
+
+type bufferedTrace struct {
+	traces    ptrace.Traces
+	firstSeen time.Time
+}
+
+// TraceBuffer holds spans by trace id so that spans of the same trace arriving
+// in different batches end up in the same transaction.
+type TraceBuffer struct {
+	mu     sync.Mutex
+	config TraceBufferConfig
+	logger *zap.Logger
+	traces map[pcommon.TraceID]*bufferedTrace
+	// trace ids in the order they were first seen, oldest first
+	order []pcommon.TraceID
+}
+
+func NewTraceBuffer(config TraceBufferConfig, logger *zap.Logger) *TraceBuffer {
+	return &TraceBuffer{config: config, logger: logger, traces: make(map[pcommon.TraceID]*bufferedTrace)}
+}
+
+// Add buffers all the spans in td. It returns the traces evicted because the
+// buffer went over its limit and that have to be processed right away.
+func (buffer *TraceBuffer) Add(td ptrace.Traces, now time.Time) ptrace.Traces {
+	buffer.mu.Lock()
+	defer buffer.mu.Unlock()
+
+	for i := 0; i < td.ResourceSpans().Len(); i++ {
+		rs := td.ResourceSpans().At(i)
+		for j := 0; j < rs.ScopeSpans().Len(); j++ {
+			scopeSpan := rs.ScopeSpans().At(j)
+			spansByTrace := make(map[pcommon.TraceID]ptrace.SpanSlice)
+			for k := 0; k < scopeSpan.Spans().Len(); k++ {
+				span := scopeSpan.Spans().At(k)
+				spans, exists := spansByTrace[span.TraceID()]
+				if !exists {
+					trace := buffer.getOrCreateTrace(span.TraceID(), now)
+					resourceSpans := trace.traces.ResourceSpans().AppendEmpty()
+					rs.Resource().CopyTo(resourceSpans.Resource())
+					resourceSpans.SetSchemaUrl(rs.SchemaUrl())
+					scopeSpans := resourceSpans.ScopeSpans().AppendEmpty()
+					scopeSpan.Scope().CopyTo(scopeSpans.Scope())
+					scopeSpans.SetSchemaUrl(scopeSpan.SchemaUrl())
+					spans = scopeSpans.Spans()
+					spansByTrace[span.TraceID()] = spans
+				}
+				span.CopyTo(spans.AppendEmpty())
+			}
+		}
+	}
+
+	evicted := ptrace.NewTraces()
+	if buffer.config.MaxTraces <= 0 {
+		return evicted
+	}
+	for len(buffer.traces) > buffer.config.MaxTraces {
+		traceID, trace := buffer.popOldest()
+		if buffer.config.EvictionPolicy == EvictionPolicyDrop {
+			buffer.logger.Debug("Dropping incomplete trace, trace buffer is full", zap.String("trace.id", traceID.String()),
+				zap.Int("spans", trace.traces.SpanCount()))
+			continue
+		}
+		trace.traces.ResourceSpans().MoveAndAppendTo(evicted.ResourceSpans())
+	}
+	return evicted
+}
+
+// Release returns the traces that were first seen more than DecisionWait ago.
+func (buffer *TraceBuffer) Release(now time.Time) ptrace.Traces {
+	buffer.mu.Lock()
+	defer buffer.mu.Unlock()
+
+	released := ptrace.NewTraces()
+	for len(buffer.order) > 0 {
+		if trace := buffer.traces[buffer.order[0]]; now.Sub(trace.firstSeen) < buffer.config.DecisionWait {
+			break
+		}
+		_, trace := buffer.popOldest()
+		trace.traces.ResourceSpans().MoveAndAppendTo(released.ResourceSpans())
+	}
+	return released
+}
+
+// Flush returns every buffered trace, regardless of how long it has been held.
+func (buffer *TraceBuffer) Flush() ptrace.Traces {
+	buffer.mu.Lock()
+	defer buffer.mu.Unlock()
+
+	flushed := ptrace.NewTraces()
+	for len(buffer.order) > 0 {
+		_, trace := buffer.popOldest()
+		trace.traces.ResourceSpans().MoveAndAppendTo(flushed.ResourceSpans())
+	}
+	return flushed
+}
+
+func (buffer *TraceBuffer) Len() int {
+	buffer.mu.Lock()
+	defer buffer.mu.Unlock()
+	return len(buffer.traces)
+}
+
+func (buffer *TraceBuffer) getOrCreateTrace(traceID pcommon.TraceID, now time.Time) *bufferedTrace {
+	if trace, exists := buffer.traces[traceID]; exists {
+		return trace
+	}
+	trace := &bufferedTrace{traces: ptrace.NewTraces(), firstSeen: now}
+	buffer.traces[traceID] = trace
+	buffer.order = append(buffer.order, traceID)
+	return trace
+}
+
+func (buffer *TraceBuffer) popOldest() (pcommon.TraceID, *bufferedTrace) {
+	traceID := buffer.order[0]
+	buffer.order = buffer.order[1:]
+	trace := buffer.traces[traceID]
+	delete(buffer.traces, traceID)
+	return traceID, trace
+}
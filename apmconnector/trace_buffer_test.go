@@ -0,0 +1,82 @@
+package apmconnector
+
+import (
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+	"go.uber.org/zap"
+	"testing"
+	"time"
+)
+
+func TestTraceBufferMergesBatches(t *testing.T) {
+	buffer := NewTraceBuffer(TraceBufferConfig{DecisionWait: time.Second, MaxTraces: 10}, zap.NewNop())
+	now := time.Now()
+
+	buffer.Add(newBufferTestTraces([16]byte{1}, [8]byte{1}), now)
+	buffer.Add(newBufferTestTraces([16]byte{1}, [8]byte{2}), now.Add(100*time.Millisecond))
+	assert.Equal(t, 1, buffer.Len())
+
+	assert.Equal(t, 0, buffer.Release(now.Add(500*time.Millisecond)).SpanCount())
+	released := buffer.Release(now.Add(time.Second))
+	assert.Equal(t, 2, released.SpanCount())
+	assert.Equal(t, 0, buffer.Len())
+}
+
+func TestTraceBufferReleasesOldestFirst(t *testing.T) {
+	buffer := NewTraceBuffer(TraceBufferConfig{DecisionWait: time.Second, MaxTraces: 10}, zap.NewNop())
+	now := time.Now()
+
+	buffer.Add(newBufferTestTraces([16]byte{1}, [8]byte{1}), now)
+	buffer.Add(newBufferTestTraces([16]byte{2}, [8]byte{2}), now.Add(time.Second))
+
+	released := buffer.Release(now.Add(1500 * time.Millisecond))
+	assert.Equal(t, 1, released.SpanCount())
+	assert.Equal(t, pcommon.TraceID([16]byte{1}), released.ResourceSpans().At(0).ScopeSpans().At(0).Spans().At(0).TraceID())
+	assert.Equal(t, 1, buffer.Len())
+}
+
+func TestTraceBufferEvictProcess(t *testing.T) {
+	buffer := NewTraceBuffer(TraceBufferConfig{DecisionWait: time.Minute, MaxTraces: 1, EvictionPolicy: EvictionPolicyProcess}, zap.NewNop())
+	now := time.Now()
+
+	assert.Equal(t, 0, buffer.Add(newBufferTestTraces([16]byte{1}, [8]byte{1}), now).SpanCount())
+	evicted := buffer.Add(newBufferTestTraces([16]byte{2}, [8]byte{2}), now)
+	assert.Equal(t, 1, evicted.SpanCount())
+	assert.Equal(t, pcommon.TraceID([16]byte{1}), evicted.ResourceSpans().At(0).ScopeSpans().At(0).Spans().At(0).TraceID())
+	assert.Equal(t, 1, buffer.Len())
+}
+
+func TestTraceBufferEvictDrop(t *testing.T) {
+	buffer := NewTraceBuffer(TraceBufferConfig{DecisionWait: time.Minute, MaxTraces: 1, EvictionPolicy: EvictionPolicyDrop}, zap.NewNop())
+	now := time.Now()
+
+	buffer.Add(newBufferTestTraces([16]byte{1}, [8]byte{1}), now)
+	evicted := buffer.Add(newBufferTestTraces([16]byte{2}, [8]byte{2}), now)
+	assert.Equal(t, 0, evicted.SpanCount())
+	assert.Equal(t, 1, buffer.Len())
+}
+
+func TestTraceBufferFlush(t *testing.T) {
+	buffer := NewTraceBuffer(TraceBufferConfig{DecisionWait: time.Minute, MaxTraces: 10}, zap.NewNop())
+	now := time.Now()
+
+	buffer.Add(newBufferTestTraces([16]byte{1}, [8]byte{1}), now)
+	buffer.Add(newBufferTestTraces([16]byte{2}, [8]byte{2}), now)
+
+	flushed := buffer.Flush()
+	assert.Equal(t, 2, flushed.SpanCount())
+	assert.Equal(t, 0, buffer.Len())
+	serviceName, _ := flushed.ResourceSpans().At(0).Resource().Attributes().Get("service.name")
+	assert.Equal(t, "service", serviceName.AsString())
+}
+
+func newBufferTestTraces(traceID pcommon.TraceID, spanID pcommon.SpanID) ptrace.Traces {
+	traces := ptrace.NewTraces()
+	resourceSpans := traces.ResourceSpans().AppendEmpty()
+	resourceSpans.Resource().Attributes().PutStr("service.name", "service")
+	span := resourceSpans.ScopeSpans().AppendEmpty().Spans().AppendEmpty()
+	span.SetTraceID(traceID)
+	span.SetSpanID(spanID)
+	return traces
+}
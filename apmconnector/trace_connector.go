@@ -22,7 +22,7 @@ func (c *ApmTraceConnector) Capabilities() consumer.Capabilities {
 }
 
 func (c *ApmTraceConnector) ConsumeTraces(ctx context.Context, td ptrace.Traces) error {
-	MutateSpans(c.logger, c.sqlparser, td)
+	MutateSpans(c.logger, c.sqlparser, c.config.SqlObfuscation, td)
 	return c.tracesConsumer.ConsumeTraces(ctx, td)
 }
 
@@ -39,7 +39,8 @@ func (c *ApmTraceConnector) Shutdown(context.Context) error {
 	return nil
 }
 
-func MutateSpans(logger *zap.Logger, sqlparser *SqlParser, td ptrace.Traces) {
+// MutateSpans adds the table of the database spans, and obfuscates or drops their statement
+func MutateSpans(logger *zap.Logger, sqlparser *SqlParser, obfuscation SqlObfuscationMode, td ptrace.Traces) {
 	for i := 0; i < td.ResourceSpans().Len(); i++ {
 		rs := td.ResourceSpans().At(i)
 		instrumentationProvider, instrumentationProviderPresent := rs.Resource().Attributes().Get("instrumentation.provider")
@@ -56,6 +57,7 @@ func MutateSpans(logger *zap.Logger, sqlparser *SqlParser, td ptrace.Traces) {
 				if parsedTable, parsed := sqlparser.ParseDbTableFromSpan(span); parsed {
 					span.Attributes().PutStr(DbSqlTableAttributeName, parsedTable)
 				}
+				ObfuscateSpanStatement(span, obfuscation)
 			}
 		}
 	}
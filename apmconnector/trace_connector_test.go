@@ -23,7 +23,7 @@ func TestMutateOneSpan(t *testing.T) {
 	addSpan(scopeSpans, attrs, spanValues)
 	logger, _ := zap.NewDevelopment()
 
-	MutateSpans(logger, NewSqlParser(), traces)
+	MutateSpans(logger, NewSqlParser(), SqlObfuscationOff, traces)
 	dbtable, dbtablePresent := scopeSpans.At(0).Attributes().Get(DbSqlTableAttributeName)
 	assert.True(t, dbtablePresent)
 	assert.Equal(t, dbtable.AsString(), "users")
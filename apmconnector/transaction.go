@@ -2,6 +2,11 @@ package apmconnector
 
 import (
 	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 
 	"go.opentelemetry.io/collector/pdata/pcommon"
 	"go.opentelemetry.io/collector/pdata/ptrace"
@@ -13,14 +18,27 @@ const (
 	DbOperationAttributeName = "db.operation"
 	DbSystemAttributeName    = "db.system"
 	DbSqlTableAttributeName  = "db.sql.table"
+	PeerServiceAttributeName = "peer.service"
 )
 
+// version suffix of the instrumentation scope names, -3.0 or _v2
+var externalLibraryVersionRegex = regexp.MustCompile(`[-_.]v?[0-9][0-9.]*$`)
+
 const (
 	WebTransactionType   TransactionType = "Web"
 	OtherTransactionType TransactionType = "Other"
 	NullTransactionType  TransactionType = "Skip"
 )
 
+// SpanCategory is the category of a span event: a database call, a call to another service or any other span
+type SpanCategory string
+
+const (
+	DatastoreSpanCategory SpanCategory = "datastore"
+	HttpSpanCategory      SpanCategory = "http"
+	GenericSpanCategory   SpanCategory = "generic"
+)
+
 func (t TransactionType) AsString() string {
 	return fmt.Sprintf("%s", t)
 }
@@ -54,13 +72,25 @@ func (apdex Apdex) GetApdexBucket(durationInSeconds float64) string {
 }
 
 type Transaction struct {
-	SdkLanguage         string
-	SpanToChildDuration map[string]int64
-	resourceMetrics     *ResourceMetrics
-	Measurements        map[string]*Measurement
-	sqlParser           *SqlParser
-	apdex               Apdex
-	RootSpan            ptrace.Span
+	SdkLanguage     string
+	SpanToChildren  map[string][]TimeInterval
+	resourceMetrics *ResourceMetrics
+	Measurements    map[string]*Measurement
+	sqlParser       *SqlParser
+	namer           *TransactionNamer
+	nameLimiter     *NameLimiter
+	errorClassifier *ErrorClassifier
+	apdex           Apdex
+	RootSpan        ptrace.Span
+	// the span the transaction was created for, the root span once it is added
+	entrySpanID pcommon.SpanID
+	// instrumentation scope of the root span
+	RootScope pcommon.InstrumentationScope
+}
+
+// TimeInterval is the time range covered by a span, in nanoseconds since the epoch
+type TimeInterval struct {
+	Start, End int64
 }
 
 type Measurement struct {
@@ -68,18 +98,29 @@ type Measurement struct {
 	DurationNanos, ExclusiveDurationNanos   int64
 	Attributes                              pcommon.Map
 	SegmentNameProvider                     func(TransactionType) string
+	// server of a database call, nil for the other measurements
+	DatastoreInstance *DatastoreInstance
+	Category          SpanCategory
 	// FIXME
 	Span ptrace.Span
 }
 
 type TransactionsMap struct {
-	sqlParser    *SqlParser
-	apdex        Apdex
-	Transactions map[string]*Transaction
+	sqlParser       *SqlParser
+	namer           *TransactionNamer
+	nameLimiter     *NameLimiter
+	errorClassifier *ErrorClassifier
+	apdex           Apdex
+	Transactions    map[string]*Transaction
+	// spans seen so far, keyed by trace id, service and span id
+	spans map[string]ptrace.Span
 }
 
-func NewTransactionsMap(apdexT float64) *TransactionsMap {
-	return &TransactionsMap{Transactions: make(map[string]*Transaction), sqlParser: NewSqlParser(), apdex: NewApdex(apdexT)}
+// NewTransactionsMap creates the transactions of a batch. The name limiter can be nil when
+// the names are not limited, and the error classifier when only the span status is used.
+func NewTransactionsMap(apdexT float64, namer *TransactionNamer, nameLimiter *NameLimiter, errorClassifier *ErrorClassifier) *TransactionsMap {
+	return &TransactionsMap{Transactions: make(map[string]*Transaction), spans: make(map[string]ptrace.Span),
+		sqlParser: NewSqlParser(), namer: namer, nameLimiter: nameLimiter, errorClassifier: errorClassifier, apdex: NewApdex(apdexT)}
 }
 
 func (transactions *TransactionsMap) ProcessTransactions() {
@@ -89,17 +130,55 @@ func (transactions *TransactionsMap) ProcessTransactions() {
 	}
 }
 
+// IndexSpan records a span so that its children can find their entry span.
+// All the spans of a batch have to be indexed before creating transactions.
+func (transactions *TransactionsMap) IndexSpan(span ptrace.Span, resourceMetrics *ResourceMetrics) {
+	transactions.spans[getSpanKey(span.TraceID(), resourceMetrics, span.SpanID())] = span
+}
+
+// GetEntrySpan walks up the parents of a span within the same service until it finds
+// the span that started the transaction. When the chain is broken (parent in another
+// service or not seen yet), the top most span that was found is returned.
+func (transactions *TransactionsMap) GetEntrySpan(span ptrace.Span, resourceMetrics *ResourceMetrics) ptrace.Span {
+	entrySpan := span
+	// guard against malformed traces with a parent cycle
+	for i := 0; i <= len(transactions.spans); i++ {
+		parent, exists := transactions.spans[getSpanKey(span.TraceID(), resourceMetrics, entrySpan.ParentSpanID())]
+		if !exists || IsEntrySpan(entrySpan, true) {
+			break
+		}
+		entrySpan = parent
+	}
+	return entrySpan
+}
+
+// GetOrCreateTransaction returns the transaction started by the entry span of span, in the
+// service of resourceMetrics. A trace going through several services, or entering the same
+// service several times, has one transaction per entry span.
 func (transactions *TransactionsMap) GetOrCreateTransaction(sdkLanguage string, span ptrace.Span, resourceMetrics *ResourceMetrics) (*Transaction, string) {
-	traceID := span.TraceID().String()
-	transaction, txExists := transactions.Transactions[traceID]
+	entrySpan := transactions.GetEntrySpan(span, resourceMetrics)
+	transactionKey := getSpanKey(span.TraceID(), resourceMetrics, entrySpan.SpanID())
+	transaction, txExists := transactions.Transactions[transactionKey]
 	if !txExists {
-		transaction = &Transaction{SdkLanguage: sdkLanguage, SpanToChildDuration: make(map[string]int64),
-			resourceMetrics: resourceMetrics, Measurements: make(map[string]*Measurement), sqlParser: transactions.sqlParser, apdex: transactions.apdex}
-		transactions.Transactions[traceID] = transaction
-		//fmt.Printf("Created transaction for: %s   %s\n", traceID, transaction.sdkLanguage)
+		transaction = &Transaction{SdkLanguage: sdkLanguage, entrySpanID: entrySpan.SpanID(), SpanToChildren: make(map[string][]TimeInterval),
+			resourceMetrics: resourceMetrics, Measurements: make(map[string]*Measurement), sqlParser: transactions.sqlParser,
+			namer: transactions.namer, nameLimiter: transactions.nameLimiter, errorClassifier: transactions.errorClassifier,
+			apdex: transactions.apdex}
+		transactions.Transactions[transactionKey] = transaction
 	}
 
-	return transaction, traceID
+	return transaction, transactionKey
+}
+
+func getSpanKey(traceID pcommon.TraceID, resourceMetrics *ResourceMetrics, spanID pcommon.SpanID) string {
+	return fmt.Sprintf("%s/%s/%s", traceID.String(), resourceMetrics.key, spanID.String())
+}
+
+// IsEntrySpan returns true for the spans that start a transaction in a service. A consumer span
+// only starts one when its parent is not in the same service, a consumer nested in a
+// transaction of the service is a part of that transaction.
+func IsEntrySpan(span ptrace.Span, hasLocalParent bool) bool {
+	return span.Kind() == ptrace.SpanKindServer || span.ParentSpanID().IsEmpty() || IsMessageConsumerSpan(span) && !hasLocalParent
 }
 
 func (transaction *Transaction) IsRootSet() bool {
@@ -110,28 +189,28 @@ func (transaction *Transaction) SetRootSpan(span ptrace.Span) {
 	transaction.RootSpan = span
 }
 
-func (transaction *Transaction) AddSpan(span ptrace.Span) {
-	if span.Kind() == ptrace.SpanKindServer {
+func (transaction *Transaction) AddSpan(span ptrace.Span, scope pcommon.InstrumentationScope) {
+	if span.Kind() == ptrace.SpanKindServer || IsMessageConsumerSpan(span) && span.SpanID() == transaction.entrySpanID {
 		transaction.SetRootSpan(span)
+		transaction.RootScope = scope
 	} else {
 		isRoot := span.ParentSpanID().IsEmpty()
 		if isRoot {
 			transaction.SetRootSpan(span)
+			transaction.RootScope = scope
 		} else {
 			parentSpanID := span.ParentSpanID().String()
-			newDuration := DurationInNanos(span)
-
-			if measurement, exists := transaction.Measurements[parentSpanID]; exists {
-				measurement.ExclusiveDurationNanos -= newDuration
-			} else {
-				transaction.SpanToChildDuration[parentSpanID] += newDuration
-			}
+			transaction.SpanToChildren[parentSpanID] = append(transaction.SpanToChildren[parentSpanID], NewTimeInterval(span))
 		}
 
 		if span.Kind() == ptrace.SpanKindClient {
 			// filter out db calls that have no parent (so no transaction)
 			if !isRoot {
-				transaction.ProcessClientSpan(span)
+				transaction.ProcessClientSpan(span, scope)
+			}
+		} else if span.Kind() == ptrace.SpanKindProducer && !isRoot {
+			if !transaction.ProcessProducerSpan(span) {
+				transaction.ProcessGenericSpan(span)
 			}
 		} else {
 			transaction.ProcessGenericSpan(span)
@@ -145,83 +224,154 @@ func NewSimpleNameProvider(name string) func(TransactionType) string {
 
 func (transaction *Transaction) AddMeasurement(measurement *Measurement) {
 	transaction.Measurements[measurement.SpanId] = measurement
-	measurement.ExclusiveDurationNanos = measurement.ExclusiveTime(transaction)
-	measurement.Attributes.PutStr("metricTimesliceName", measurement.MetricTimesliceName)
 }
 
+// ProcessDatabaseSpan records a database call. Calls without a known table are named after
+// their operation only, Datastore/operation/redis/GET.
 func (transaction *Transaction) ProcessDatabaseSpan(span ptrace.Span) bool {
-	if dbSystem, dbSystemPresent := span.Attributes().Get(DbSystemAttributeName); dbSystemPresent {
-		if dbOperation, dbOperationPresent := span.Attributes().Get(DbOperationAttributeName); dbOperationPresent {
-			dbTable, _ := transaction.sqlParser.ParseDbTableFromSpan(span)
-			attributes := pcommon.NewMap()
-			attributes.EnsureCapacity(10)
-			attributes.PutStr(DbOperationAttributeName, dbOperation.AsString())
-			attributes.PutStr(DbSystemAttributeName, dbSystem.AsString())
-			attributes.PutStr(DbSqlTableAttributeName, dbTable)
-
-			for _, key := range []string{"net.peer.name", "db.name"} {
-				if value, exists := span.Attributes().Get(key); exists {
-					attributes.PutStr(key, value.AsString())
-				}
-			}
+	dbSystem, dbSystemPresent := DbSystemAttribute.Get(span.Attributes())
+	if !dbSystemPresent {
+		return false
+	}
+	call := GetDatastoreCall(transaction.sqlParser, span, dbSystem.AsString())
+	if call.Operation == "" {
+		return false
+	}
 
-			timesliceName := fmt.Sprintf("Datastore/statement/%s/%s/%s", dbSystem.AsString(), dbTable, dbOperation.AsString())
-			measurement := Measurement{SpanId: span.SpanID().String(), MetricName: "apm.service.datastore.operation.duration", Span: span,
-				DurationNanos: DurationInNanos(span), Attributes: attributes, SegmentNameProvider: NewSimpleNameProvider(dbSystem.AsString()), MetricTimesliceName: timesliceName}
+	dbTable := call.Table
+	if dbTable == "" {
+		dbTable = "unknown"
+	}
+	attributes := pcommon.NewMap()
+	attributes.EnsureCapacity(10)
+	attributes.PutStr(DbOperationAttributeName, call.Operation)
+	attributes.PutStr(DbSystemAttributeName, dbSystem.AsString())
+	attributes.PutStr(DbSqlTableAttributeName, dbTable)
 
-			transaction.AddMeasurement(&measurement)
+	if serverAddress, exists := ServerAddressAttribute.Get(span.Attributes()); exists {
+		attributes.PutStr("net.peer.name", serverAddress.AsString())
+	}
+	if dbNamespace, exists := DbNamespaceAttribute.Get(span.Attributes()); exists {
+		attributes.PutStr("db.name", dbNamespace.AsString())
+	}
 
-			return true
-		}
+	timesliceName := fmt.Sprintf("Datastore/statement/%s/%s/%s", dbSystem.AsString(), dbTable, call.Operation)
+	if call.Table == "" {
+		timesliceName = fmt.Sprintf("Datastore/operation/%s/%s", dbSystem.AsString(), call.Operation)
 	}
-	return false
+	measurement := Measurement{SpanId: span.SpanID().String(), MetricName: "apm.service.datastore.operation.duration", Span: span,
+		DurationNanos: DurationInNanos(span), Attributes: attributes, SegmentNameProvider: NewSimpleNameProvider(dbSystem.AsString()), MetricTimesliceName: timesliceName,
+		DatastoreInstance: GetDatastoreInstance(span, dbSystem.AsString(), transaction.resourceMetrics.hostName), Category: DatastoreSpanCategory}
+
+	transaction.AddMeasurement(&measurement)
+	return true
 }
 
-func (transaction *Transaction) ProcessExternalSpan(span ptrace.Span) bool {
-	if serverAddress, serverAddressPresent := span.Attributes().Get("server.address"); serverAddressPresent {
-		attributes := pcommon.NewMap()
-		attributes.PutStr("external.host", serverAddress.AsString())
-
-		segmentNameProvider := func(t TransactionType) string {
-			switch t {
-			case WebTransactionType:
-				return "Web external"
-			default:
-				return "Background external"
-			}
+func ExternalSegmentNameProvider(t TransactionType) string {
+	switch t {
+	case WebTransactionType:
+		return "Web external"
+	default:
+		return "Background external"
+	}
+}
+
+// ProcessExternalSpan records a call to another service. The host comes from server.address,
+// or else from the url or peer.service, and the library is the instrumentation scope.
+func (transaction *Transaction) ProcessExternalSpan(span ptrace.Span, scope pcommon.InstrumentationScope) bool {
+	host := GetExternalHost(span)
+	if host == "" {
+		return false
+	}
+	attributes := pcommon.NewMap()
+	attributes.PutStr("external.host", host)
+
+	timesliceName := fmt.Sprintf("External/%s/%s", host, GetExternalLibrary(scope))
+	if method, exists := HttpRequestMethodAttribute.Get(span.Attributes()); exists {
+		attributes.PutStr("http.method", method.AsString())
+		timesliceName = fmt.Sprintf("%s/%s", timesliceName, method.AsString())
+	}
+	if peerService, exists := span.Attributes().Get(PeerServiceAttributeName); exists {
+		attributes.PutStr(PeerServiceAttributeName, peerService.AsString())
+	}
+	if statusCode, exists := GetHttpStatusCode(span); exists {
+		attributes.PutStr("http.statusClass", fmt.Sprintf("%dxx", statusCode/100))
+	}
+
+	measurement := Measurement{SpanId: span.SpanID().String(), MetricName: "apm.service.external.host.duration", Span: span,
+		DurationNanos: DurationInNanos(span), Attributes: attributes, SegmentNameProvider: ExternalSegmentNameProvider, MetricTimesliceName: timesliceName,
+		Category: HttpSpanCategory}
+
+	transaction.AddMeasurement(&measurement)
+	return true
+}
+
+// GetExternalHost returns the host a client span calls, or an empty string when it is not known
+func GetExternalHost(span ptrace.Span) string {
+	if serverAddress, exists := ServerAddressAttribute.Get(span.Attributes()); exists {
+		return serverAddress.AsString()
+	}
+	if fullUrl, exists := UrlFullAttribute.Get(span.Attributes()); exists {
+		if parsedUrl, err := url.Parse(fullUrl.AsString()); err == nil && parsedUrl.Hostname() != "" {
+			return parsedUrl.Hostname()
 		}
-		timesliceName := fmt.Sprintf("External/%s/all", serverAddress.AsString())
-		measurement := Measurement{SpanId: span.SpanID().String(), MetricName: "apm.service.external.host.duration", Span: span,
-			DurationNanos: DurationInNanos(span), Attributes: attributes, SegmentNameProvider: segmentNameProvider, MetricTimesliceName: timesliceName}
-
-		transaction.AddMeasurement(&measurement)
-		/*
-			metric := AddMetric(transaction.MetricSlice, "apm.service.transaction.external.duration")
-			dp := SetHistogramFromSpan(metric, span)
-			span.Attributes().CopyTo(dp.Attributes())
-			dp.Attributes().PutStr("external.host", serverAddress.AsString())
-		*/
-		// FIXME
-		//dp.Attributes().PutStr("transactionType", "Web")
+	}
+	if peerService, exists := span.Attributes().Get(PeerServiceAttributeName); exists {
+		return peerService.AsString()
+	}
+	return ""
+}
 
+// GetExternalLibrary returns a short name for the instrumentation library of a client span:
+// io.opentelemetry.okhttp-3.0 is okhttp, go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp is otelhttp
+func GetExternalLibrary(scope pcommon.InstrumentationScope) string {
+	library := scope.Name()
+	if i := strings.LastIndex(library, "/"); i >= 0 {
+		library = library[i+1:]
+	}
+	for _, prefix := range []string{"io.opentelemetry.", "opentelemetry.instrumentation."} {
+		library = strings.TrimPrefix(library, prefix)
+	}
+	library = externalLibraryVersionRegex.ReplaceAllString(library, "")
+	if library == "" {
+		return "http"
+	}
+	return library
+}
+
+// GetHttpStatusCode returns the response status code, some instrumentations send it as a string
+func GetHttpStatusCode(span ptrace.Span) (int64, bool) {
+	statusCode, exists := HttpResponseStatusCodeAttribute.Get(span.Attributes())
+	if !exists {
+		return 0, false
+	}
+	code, err := strconv.ParseInt(statusCode.AsString(), 10, 64)
+	return code, err == nil
+}
+
+// IsFailedExternalCall returns true when a client call failed, with an error status or a 4xx or 5xx response
+func IsFailedExternalCall(span ptrace.Span) bool {
+	if span.Status().Code() == ptrace.StatusCodeError {
 		return true
 	}
-	return false
+	statusCode, exists := GetHttpStatusCode(span)
+	return exists && statusCode >= 400
 }
 
 func (transaction *Transaction) ProcessGenericSpan(span ptrace.Span) bool {
 	attributes := pcommon.NewMap()
 	timesliceName := fmt.Sprintf("Custom/%s", span.Name())
 	measurement := Measurement{SpanId: span.SpanID().String(), MetricName: "newrelic.timeslice.value", Span: span,
-		DurationNanos: DurationInNanos(span), Attributes: attributes, SegmentNameProvider: NewSimpleNameProvider(transaction.SdkLanguage), MetricTimesliceName: timesliceName}
+		DurationNanos: DurationInNanos(span), Attributes: attributes, SegmentNameProvider: NewSimpleNameProvider(transaction.SdkLanguage), MetricTimesliceName: timesliceName,
+		Category: GenericSpanCategory}
 
 	transaction.AddMeasurement(&measurement)
 
 	return true
 }
 
-func (transaction *Transaction) ProcessClientSpan(span ptrace.Span) bool {
-	return transaction.ProcessDatabaseSpan(span) || transaction.ProcessExternalSpan(span)
+func (transaction *Transaction) ProcessClientSpan(span ptrace.Span, scope pcommon.InstrumentationScope) bool {
+	return transaction.ProcessDatabaseSpan(span) || transaction.ProcessRpcSpan(span) || transaction.ProcessExternalSpan(span, scope)
 }
 
 func (transaction *Transaction) ProcessRootSpan() bool {
@@ -230,14 +380,18 @@ func (transaction *Transaction) ProcessRootSpan() bool {
 	}
 	span := transaction.RootSpan
 
-	transactionName, transactionType := GetTransactionMetricName(span)
+	transactionName, transactionType := transaction.namer.GetTransactionMetricName(span, transaction.RootScope)
 	if transactionType == NullTransactionType {
 		return true
 	}
+	transactionName = transaction.nameLimiter.LimitTransactionName(transaction.resourceMetrics, transactionName, transactionType, span.EndTimestamp())
 
-	err := span.Status().Code() == ptrace.StatusCodeError
+	errorClassification := transaction.errorClassifier.Classify(span)
+	err := errorClassification == UnexpectedError
 	if err {
 		transaction.IncrementErrorCount(transactionName, transactionType, span.EndTimestamp())
+	} else if errorClassification == ExpectedError {
+		transaction.IncrementExpectedErrorCount(transactionName, transactionType, span.EndTimestamp())
 	}
 
 	{
@@ -247,7 +401,10 @@ func (transaction *Transaction) ProcessRootSpan() bool {
 
 		transaction.resourceMetrics.RecordHistogramFromSpan("apm.service.transaction.duration", attributes, span)
 	}
-	transaction.GenerateApdexMetrics(span, err, transactionName, transactionType)
+	// apdex only makes sense for requests someone is waiting on
+	if transactionType == WebTransactionType {
+		transaction.GenerateApdexMetrics(span, err, transactionName, transactionType)
+	}
 
 	/* FIXME
 	//span.Attributes().EnsureCapacity(span.Attributes().Len() + 2)
@@ -257,17 +414,27 @@ func (transaction *Transaction) ProcessRootSpan() bool {
 	*/
 
 	breakdownBySegment := make(map[string]int64)
-	totalBreakdownNanos := int64(0)
 	for _, measurement := range transaction.Measurements {
+		// all the children are known by now, so exclusive times can be computed
+		measurement.ExclusiveDurationNanos = measurement.ExclusiveTime(transaction)
+		measurement.MetricTimesliceName = transaction.nameLimiter.LimitSegmentName(transaction.resourceMetrics,
+			measurement.MetricTimesliceName, measurement.Span.EndTimestamp())
+		measurement.Attributes.PutStr("metricTimesliceName", measurement.MetricTimesliceName)
 		transaction.ProcessMeasurement(measurement, transactionType, transactionName)
+		transaction.RecordRollups(measurement, transactionType)
+		if measurement.Category == HttpSpanCategory && IsFailedExternalCall(measurement.Span) {
+			transaction.IncrementExternalErrorCount(measurement, transactionType)
+		}
 		segmentName := measurement.SegmentNameProvider(transactionType)
 		breakdownBySegment[segmentName] += measurement.ExclusiveDurationNanos
-		totalBreakdownNanos += measurement.ExclusiveDurationNanos
 	}
 
-	remainingNanos := DurationInNanos(span) - totalBreakdownNanos
-	if remainingNanos > 0 {
-		breakdownBySegment[transaction.SdkLanguage] += remainingNanos
+	// a root span that is not a server span is already measured as a generic span
+	if _, rootMeasured := transaction.Measurements[span.SpanID().String()]; !rootMeasured {
+		remainingNanos := ExclusiveDuration(NewTimeInterval(span), transaction.SpanToChildren[span.SpanID().String()])
+		if remainingNanos > 0 {
+			breakdownBySegment[transaction.SdkLanguage] += remainingNanos
+		}
 	}
 
 	overviewMetricName := transactionType.GetOverviewMetricName()
@@ -282,6 +449,37 @@ func (transaction *Transaction) ProcessRootSpan() bool {
 	return true
 }
 
+// TransactionTotals sums the calls of a transaction per category
+type TransactionTotals struct {
+	DatabaseDurationNanos, ExternalDurationNanos int64
+	DatabaseCallCount, ExternalCallCount         int
+	// sum of the exclusive durations of all the segments, more than the duration when calls are concurrent
+	TotalTimeNanos int64
+}
+
+// GetTotals sums the measurements of the transaction, all its spans must have been added
+func (transaction *Transaction) GetTotals() TransactionTotals {
+	var totals TransactionTotals
+	for _, measurement := range transaction.Measurements {
+		totals.TotalTimeNanos += measurement.ExclusiveTime(transaction)
+		switch measurement.Category {
+		case DatastoreSpanCategory:
+			totals.DatabaseDurationNanos += measurement.DurationNanos
+			totals.DatabaseCallCount++
+		case HttpSpanCategory:
+			totals.ExternalDurationNanos += measurement.DurationNanos
+			totals.ExternalCallCount++
+		}
+	}
+	if transaction.IsRootSet() {
+		if _, rootMeasured := transaction.Measurements[transaction.RootSpan.SpanID().String()]; !rootMeasured {
+			totals.TotalTimeNanos += ExclusiveDuration(NewTimeInterval(transaction.RootSpan),
+				transaction.SpanToChildren[transaction.RootSpan.SpanID().String()])
+		}
+	}
+	return totals
+}
+
 func (transaction *Transaction) GenerateApdexMetrics(span ptrace.Span, err bool, transactionName string, transactionType TransactionType) {
 	attributes := pcommon.NewMap()
 	attributes.PutDouble("apdex.value", transaction.apdex.apdexSatisfying)
@@ -314,6 +512,26 @@ func (transaction *Transaction) IncrementErrorCount(transactionName string, tran
 	}
 }
 
+// IncrementExternalErrorCount counts a failed call to another service, apart from the errors of the transaction
+func (transaction *Transaction) IncrementExternalErrorCount(measurement *Measurement, transactionType TransactionType) {
+	attributes := pcommon.NewMap()
+	for _, key := range []string{"external.host", "http.statusClass"} {
+		if value, exists := measurement.Attributes.Get(key); exists {
+			attributes.PutStr(key, value.AsString())
+		}
+	}
+	attributes.PutStr("transactionType", transactionType.AsString())
+	transaction.resourceMetrics.IncrementSum("apm.service.external.error.count", attributes, measurement.Span.EndTimestamp())
+}
+
+// IncrementExpectedErrorCount counts the expected errors, which are not transaction errors
+func (transaction *Transaction) IncrementExpectedErrorCount(transactionName string, transactionType TransactionType, timestamp pcommon.Timestamp) {
+	attributes := pcommon.NewMap()
+	attributes.PutStr("transactionName", transactionName)
+	attributes.PutStr("transactionType", transactionType.AsString())
+	transaction.resourceMetrics.IncrementSum("apm.service.transaction.error.expected.count", attributes, timestamp)
+}
+
 func (transaction *Transaction) ProcessMeasurement(measurement *Measurement, transactionType TransactionType, transactionName string) {
 	//	fmt.Printf("Name: %s total: %d exclusive: %d    id:%s\n", measurement.metricName, measurement.durationNanos, exclusiveDuration, measurement.spanId)
 
@@ -331,6 +549,67 @@ func (transaction *Transaction) ProcessMeasurement(measurement *Measurement, tra
 		transaction.resourceMetrics.RecordHistogram("apm.service.transaction.overview", attributes,
 			measurement.Span.StartTimestamp(), measurement.Span.EndTimestamp(), measurement.ExclusiveDurationNanos)
 	}
+
+	if instance := measurement.DatastoreInstance; instance != nil {
+		attributes := pcommon.NewMap()
+		attributes.PutStr(DbSystemAttributeName, instance.System)
+		attributes.PutStr("datastore.instance.host", instance.Host)
+		attributes.PutStr("datastore.instance.portOrPath", instance.PortOrPath)
+		attributes.PutStr("metricTimesliceName", transaction.nameLimiter.LimitSegmentName(transaction.resourceMetrics,
+			instance.TimesliceName(), measurement.Span.EndTimestamp()))
+		attributes.PutStr("transactionType", transactionType.AsString())
+		attributes.PutStr("scope", transactionName)
+
+		transaction.resourceMetrics.RecordHistogramFromSpan("apm.service.datastore.instance.duration", attributes, measurement.Span)
+	}
+}
+
+// RecordRollups records the datastore and external calls of a transaction in the summary metrics:
+// Datastore/all, Datastore/allWeb or allOther, Datastore/{system}/all, Datastore/operation/{system}/{operation},
+// External/all, External/allWeb or allOther and External/{host}/all
+func (transaction *Transaction) RecordRollups(measurement *Measurement, transactionType TransactionType) {
+	allTransactionType := "allOther"
+	if transactionType == WebTransactionType {
+		allTransactionType = "allWeb"
+	}
+
+	var metricName string
+	var rollups []string
+	switch {
+	case strings.HasPrefix(measurement.MetricTimesliceName, "Datastore/"):
+		metricName = "apm.service.datastore.rollup.duration"
+		rollups = []string{"Datastore/all", "Datastore/" + allTransactionType}
+		if dbSystem, exists := measurement.Attributes.Get(DbSystemAttributeName); exists {
+			rollups = append(rollups, fmt.Sprintf("Datastore/%s/all", dbSystem.AsString()))
+			// the calls without a table are already named after their operation
+			namedAfterOperation := strings.HasPrefix(measurement.MetricTimesliceName, "Datastore/operation/")
+			if dbOperation, exists := measurement.Attributes.Get(DbOperationAttributeName); exists && !namedAfterOperation {
+				rollups = append(rollups, transaction.nameLimiter.LimitSegmentName(transaction.resourceMetrics,
+					fmt.Sprintf("Datastore/operation/%s/%s", dbSystem.AsString(), dbOperation.AsString()), measurement.Span.EndTimestamp()))
+			}
+		}
+	case strings.HasPrefix(measurement.MetricTimesliceName, "External/"):
+		metricName = "apm.service.external.rollup.duration"
+		rollups = []string{"External/all", "External/" + allTransactionType}
+		if host, exists := measurement.Attributes.Get("external.host"); exists {
+			rollups = append(rollups, transaction.nameLimiter.LimitSegmentName(transaction.resourceMetrics,
+				fmt.Sprintf("External/%s/all", host.AsString()), measurement.Span.EndTimestamp()))
+		}
+	default:
+		return
+	}
+
+	for _, rollup := range rollups {
+		attributes := pcommon.NewMap()
+		attributes.PutStr("metricTimesliceName", rollup)
+		attributes.PutStr("transactionType", transactionType.AsString())
+		transaction.resourceMetrics.RecordHistogramFromSpan(metricName, attributes, measurement.Span)
+	}
+}
+
+// IsErrorSpan returns true when the span status is an error, or the span is an RPC with a server error code
+func IsErrorSpan(span ptrace.Span) bool {
+	return span.Status().Code() == ptrace.StatusCodeError || IsRpcServerError(span)
 }
 
 func DurationInNanos(span ptrace.Span) int64 {
@@ -338,29 +617,57 @@ func DurationInNanos(span ptrace.Span) int64 {
 }
 
 func (measurement Measurement) ExclusiveTime(transaction *Transaction) int64 {
-	childDurationNanos := transaction.SpanToChildDuration[measurement.SpanId]
-	// we no longer need the summed child durations, delete that
-	delete(transaction.SpanToChildDuration, measurement.SpanId)
-	return measurement.DurationNanos - childDurationNanos
+	return ExclusiveDuration(NewTimeInterval(measurement.Span), transaction.SpanToChildren[measurement.SpanId])
 }
 
-func GetTransactionMetricName(span ptrace.Span) (string, TransactionType) {
-	if span.Kind() != ptrace.SpanKindServer {
-		return "", NullTransactionType
-	}
+func NewTimeInterval(span ptrace.Span) TimeInterval {
+	return TimeInterval{Start: int64(span.StartTimestamp()), End: int64(span.EndTimestamp())}
+}
 
-	if httpRoute, routePresent := span.Attributes().Get("http.route"); routePresent {
-		return GetWebTransactionMetricName(span, httpRoute.Str(), "http.route")
+// ExclusiveDuration returns the time of the parent interval not covered by any of its children.
+// Children can overlap (async calls) and are clamped to the parent to absorb clock skew.
+func ExclusiveDuration(parent TimeInterval, children []TimeInterval) int64 {
+	clamped := make([]TimeInterval, 0, len(children))
+	for _, child := range children {
+		if child.Start < parent.Start {
+			child.Start = parent.Start
+		}
+		if child.End > parent.End {
+			child.End = parent.End
+		}
+		if child.End > child.Start {
+			clamped = append(clamped, child)
+		}
 	}
-	if urlPath, urlPathPresent := span.Attributes().Get("url.path"); urlPathPresent {
-		return GetWebTransactionMetricName(span, urlPath.Str(), "Uri")
+	sort.Slice(clamped, func(i, j int) bool { return clamped[i].Start < clamped[j].Start })
+
+	covered := int64(0)
+	current := TimeInterval{Start: parent.Start, End: parent.Start}
+	for _, child := range clamped {
+		if child.Start > current.End {
+			covered += current.End - current.Start
+			current = child
+		} else if child.End > current.End {
+			current.End = child.End
+		}
+	}
+	covered += current.End - current.Start
+
+	exclusive := parent.End - parent.Start - covered
+	if exclusive < 0 {
+		return 0
 	}
-	return "WebTransaction/Other/unknown", WebTransactionType
+	return exclusive
+}
+
+// GetTransactionMetricName names a transaction without any naming rule
+func GetTransactionMetricName(span ptrace.Span) (string, TransactionType) {
+	return (&TransactionNamer{}).GetTransactionMetricName(span, pcommon.NewInstrumentationScope())
 }
 
 func GetWebTransactionMetricName(span ptrace.Span, name, nameType string) (string, TransactionType) {
-	if method, methodPresent := span.Attributes().Get("http.method"); methodPresent {
-		return fmt.Sprintf("WebTransaction/%s%s (%s)", nameType, name, method.Str()), WebTransactionType
+	if method, methodPresent := HttpRequestMethodAttribute.Get(span.Attributes()); methodPresent {
+		return fmt.Sprintf("WebTransaction/%s%s (%s)", nameType, name, method.AsString()), WebTransactionType
 	} else {
 		return fmt.Sprintf("WebTransaction/%s%s", nameType, name), WebTransactionType
 	}
@@ -374,10 +681,14 @@ func GetSdkLanguage(attributes pcommon.Map) string {
 	return "unknown"
 }
 
-// Generate the metrc used for the host instances drop down
+// Generate the metrc used for the host instances drop down, once per resource and flush
 func GenerateInstanceMetric(resourceMetrics *ResourceMetrics, hostName string, timestamp pcommon.Timestamp) {
+	if resourceMetrics.instanceRecorded {
+		return
+	}
+	resourceMetrics.instanceRecorded = true
 	attributes := pcommon.NewMap()
 	attributes.PutStr("instanceName", hostName)
 	attributes.PutStr("host.displayName", hostName)
-	resourceMetrics.IncrementSum("apm.service.instance.count", pcommon.NewMap(), timestamp)
+	resourceMetrics.IncrementSum("apm.service.instance.count", attributes, timestamp)
 }
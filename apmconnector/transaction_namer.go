@@ -0,0 +1,226 @@
+package apmconnector
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+)
+
+type NamingRuleType string
+
+const (
+	// RegexNamingRule replaces the parts of the name matching a regular expression,
+	// the replacement can reference groups with $1 or ${name}
+	RegexNamingRule NamingRuleType = "regex"
+	// IdSegmentsNamingRule replaces numeric, UUID and hexadecimal path segments with *
+	IdSegmentsNamingRule NamingRuleType = "idSegments"
+	// QueryStringNamingRule strips the query string and the fragment
+	QueryStringNamingRule NamingRuleType = "queryString"
+)
+
+var (
+	numericSegmentRegex = regexp.MustCompile(`^[0-9]+$`)
+	uuidSegmentRegex    = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	hexSegmentRegex     = regexp.MustCompile(`^(0x)?[0-9a-fA-F]{8,}$`)
+)
+
+// NamingRule rewrites the url path of a transaction name
+type NamingRule struct {
+	config NamingRuleConfig
+	re     *regexp.Regexp
+}
+
+func NewNamingRule(config NamingRuleConfig) (*NamingRule, error) {
+	rule := &NamingRule{config: config}
+	switch config.Type {
+	case "", RegexNamingRule:
+		re, err := regexp.Compile(config.Match)
+		if err != nil {
+			return nil, err
+		}
+		rule.re = re
+	case IdSegmentsNamingRule, QueryStringNamingRule:
+	default:
+		return nil, fmt.Errorf("unknown naming rule type: %s", config.Type)
+	}
+	return rule, nil
+}
+
+// Apply returns the rewritten name, and whether the rule matched
+func (rule *NamingRule) Apply(name string) (string, bool) {
+	switch rule.config.Type {
+	case IdSegmentsNamingRule:
+		segments := strings.Split(name, "/")
+		matched := false
+		for i, segment := range segments {
+			if isIdSegment(segment) {
+				segments[i] = "*"
+				matched = true
+			}
+		}
+		return strings.Join(segments, "/"), matched
+	case QueryStringNamingRule:
+		if i := strings.IndexAny(name, "?#"); i >= 0 {
+			return name[:i], true
+		}
+		return name, false
+	default:
+		if !rule.re.MatchString(name) {
+			return name, false
+		}
+		return rule.re.ReplaceAllString(name, rule.config.Replacement), true
+	}
+}
+
+func isIdSegment(segment string) bool {
+	if numericSegmentRegex.MatchString(segment) || uuidSegmentRegex.MatchString(segment) {
+		return true
+	}
+	// require a digit so that plain words made of a-f are not replaced
+	return hexSegmentRegex.MatchString(segment) && strings.ContainsAny(segment, "0123456789")
+}
+
+// OtherTransactionRule promotes a root span to a background transaction
+type OtherTransactionRule struct {
+	config  OtherTransactionRuleConfig
+	scopeRe *regexp.Regexp
+}
+
+func NewOtherTransactionRule(config OtherTransactionRuleConfig) (*OtherTransactionRule, error) {
+	if len(config.SpanKinds) == 0 && config.ScopeName == "" && config.Attribute == "" {
+		return nil, fmt.Errorf("other transaction rule %s has no trigger", config.Category)
+	}
+	for _, kind := range config.SpanKinds {
+		if _, exists := spanKindsByName[strings.ToLower(kind)]; !exists {
+			return nil, fmt.Errorf("unknown span kind: %s", kind)
+		}
+	}
+	rule := &OtherTransactionRule{config: config}
+	if rule.config.Category == "" {
+		rule.config.Category = "Job"
+	}
+	if config.ScopeName != "" {
+		re, err := regexp.Compile(config.ScopeName)
+		if err != nil {
+			return nil, err
+		}
+		rule.scopeRe = re
+	}
+	return rule, nil
+}
+
+var spanKindsByName = map[string]ptrace.SpanKind{
+	"unspecified": ptrace.SpanKindUnspecified,
+	"internal":    ptrace.SpanKindInternal,
+	"server":      ptrace.SpanKindServer,
+	"client":      ptrace.SpanKindClient,
+	"producer":    ptrace.SpanKindProducer,
+	"consumer":    ptrace.SpanKindConsumer,
+}
+
+// Matches returns true when the root span matches all the triggers of the rule
+func (rule *OtherTransactionRule) Matches(span ptrace.Span, scope pcommon.InstrumentationScope) bool {
+	if !span.ParentSpanID().IsEmpty() {
+		return false
+	}
+	if len(rule.config.SpanKinds) > 0 {
+		kindMatches := false
+		for _, kind := range rule.config.SpanKinds {
+			if spanKindsByName[strings.ToLower(kind)] == span.Kind() {
+				kindMatches = true
+				break
+			}
+		}
+		if !kindMatches {
+			return false
+		}
+	}
+	if rule.scopeRe != nil && !rule.scopeRe.MatchString(scope.Name()) {
+		return false
+	}
+	if rule.config.Attribute != "" {
+		if _, exists := span.Attributes().Get(rule.config.Attribute); !exists {
+			return false
+		}
+	}
+	return true
+}
+
+// TransactionNamer names transactions from their entry span, applying the naming rules
+// to the url paths of the transactions that have no route
+type TransactionNamer struct {
+	rules                 []*NamingRule
+	otherTransactionRules []*OtherTransactionRule
+}
+
+func NewTransactionNamer(namingRules []NamingRuleConfig, otherTransactionRules []OtherTransactionRuleConfig) (*TransactionNamer, error) {
+	namer := &TransactionNamer{}
+	for _, config := range namingRules {
+		rule, err := NewNamingRule(config)
+		if err != nil {
+			return nil, fmt.Errorf("invalid namingRules: %w", err)
+		}
+		namer.rules = append(namer.rules, rule)
+	}
+	for _, config := range otherTransactionRules {
+		rule, err := NewOtherTransactionRule(config)
+		if err != nil {
+			return nil, fmt.Errorf("invalid otherTransactions: %w", err)
+		}
+		namer.otherTransactionRules = append(namer.otherTransactionRules, rule)
+	}
+	return namer, nil
+}
+
+// ApplyRules runs the naming rules in order. It returns the rewritten name, and false
+// when a rule marked the name as ignored.
+func (namer *TransactionNamer) ApplyRules(name string) (string, bool) {
+	for _, rule := range namer.rules {
+		newName, matched := rule.Apply(name)
+		if !matched {
+			continue
+		}
+		if rule.config.Ignore {
+			return "", false
+		}
+		name = newName
+		if rule.config.Terminate {
+			break
+		}
+	}
+	return name, true
+}
+
+func (namer *TransactionNamer) GetTransactionMetricName(span ptrace.Span, scope pcommon.InstrumentationScope) (string, TransactionType) {
+	if IsMessageConsumerSpan(span) {
+		return GetMessageTransactionMetricName(span)
+	}
+	if span.Kind() != ptrace.SpanKindServer {
+		for _, rule := range namer.otherTransactionRules {
+			if rule.Matches(span, scope) {
+				return fmt.Sprintf("OtherTransaction/%s/%s", rule.config.Category, span.Name()), OtherTransactionType
+			}
+		}
+		return "", NullTransactionType
+	}
+
+	if rpcSystem, rpcSystemPresent := span.Attributes().Get(RpcSystemAttributeName); rpcSystemPresent {
+		return GetRpcTransactionMetricName(span, rpcSystem.AsString())
+	}
+	if httpRoute, routePresent := span.Attributes().Get("http.route"); routePresent {
+		return GetWebTransactionMetricName(span, httpRoute.Str(), "http.route")
+	}
+	if urlPath, urlPathPresent := UrlPathAttribute.Get(span.Attributes()); urlPathPresent {
+		// http.target, from the older conventions, also has the query string
+		path, _, _ := strings.Cut(urlPath.AsString(), "?")
+		path, keep := namer.ApplyRules(path)
+		if !keep {
+			return "", NullTransactionType
+		}
+		return GetWebTransactionMetricName(span, path, "Uri")
+	}
+	return "WebTransaction/Other/unknown", WebTransactionType
+}
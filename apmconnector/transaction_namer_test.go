@@ -0,0 +1,196 @@
+package apmconnector
+
+import (
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+	"testing"
+)
+
+func TestNamingRuleIdSegments(t *testing.T) {
+	rule, err := NewNamingRule(NamingRuleConfig{Type: IdSegmentsNamingRule})
+	assert.NoError(t, err)
+
+	name, matched := rule.Apply("/users/8812/orders/1234")
+	assert.True(t, matched)
+	assert.Equal(t, "/users/*/orders/*", name)
+
+	name, _ = rule.Apply("/sessions/3f2504e0-4f89-11d3-9a0c-0305e82c3301/items/5f1b9c2e8d3a4b6c7d8e9f01")
+	assert.Equal(t, "/sessions/*/items/*", name)
+
+	name, matched = rule.Apply("/users/deadbeef/facade")
+	assert.False(t, matched)
+	assert.Equal(t, "/users/deadbeef/facade", name)
+}
+
+func TestNamingRuleQueryString(t *testing.T) {
+	rule, err := NewNamingRule(NamingRuleConfig{Type: QueryStringNamingRule})
+	assert.NoError(t, err)
+
+	name, matched := rule.Apply("/search?q=shoes&page=2")
+	assert.True(t, matched)
+	assert.Equal(t, "/search", name)
+
+	_, matched = rule.Apply("/search")
+	assert.False(t, matched)
+}
+
+func TestNamingRuleRegex(t *testing.T) {
+	rule, err := NewNamingRule(NamingRuleConfig{Match: `^/api/v[0-9]+/(\w+)/.*$`, Replacement: "/api/$1/*"})
+	assert.NoError(t, err)
+
+	name, matched := rule.Apply("/api/v2/accounts/42/settings")
+	assert.True(t, matched)
+	assert.Equal(t, "/api/accounts/*", name)
+}
+
+func TestNamingRuleInvalid(t *testing.T) {
+	_, err := NewNamingRule(NamingRuleConfig{Match: `(`})
+	assert.Error(t, err)
+	_, err = NewNamingRule(NamingRuleConfig{Type: "soundex"})
+	assert.Error(t, err)
+}
+
+func TestApplyRulesInOrder(t *testing.T) {
+	namer, err := NewTransactionNamer([]NamingRuleConfig{
+		{Type: QueryStringNamingRule},
+		{Match: `^/static/.*`, Ignore: true},
+		{Match: `^/legacy/.*`, Replacement: "/legacy/*", Terminate: true},
+		{Type: IdSegmentsNamingRule},
+	}, nil)
+	assert.NoError(t, err)
+
+	name, keep := namer.ApplyRules("/users/12?expand=true")
+	assert.True(t, keep)
+	assert.Equal(t, "/users/*", name)
+
+	_, keep = namer.ApplyRules("/static/app.js")
+	assert.False(t, keep)
+
+	name, keep = namer.ApplyRules("/legacy/12")
+	assert.True(t, keep)
+	assert.Equal(t, "/legacy/*", name)
+}
+
+func TestTransactionNamerUrlPath(t *testing.T) {
+	namer, _ := NewTransactionNamer([]NamingRuleConfig{{Type: IdSegmentsNamingRule}, {Match: `^/health$`, Ignore: true}}, nil)
+	span := ptrace.NewSpan()
+	span.SetKind(ptrace.SpanKindServer)
+	span.Attributes().PutStr("url.path", "/users/8812/orders/1234")
+	span.Attributes().PutStr("http.method", "GET")
+
+	name, txType := namer.GetTransactionMetricName(span, pcommon.NewInstrumentationScope())
+	assert.Equal(t, "WebTransaction/Uri/users/*/orders/* (GET)", name)
+	assert.Equal(t, WebTransactionType, txType)
+
+	span.Attributes().PutStr("url.path", "/health")
+	_, txType = namer.GetTransactionMetricName(span, pcommon.NewInstrumentationScope())
+	assert.Equal(t, NullTransactionType, txType)
+}
+
+func TestTransactionNamerRouteNotRewritten(t *testing.T) {
+	namer, _ := NewTransactionNamer([]NamingRuleConfig{{Match: `users`, Replacement: "people"}}, nil)
+	span := ptrace.NewSpan()
+	span.SetKind(ptrace.SpanKindServer)
+	span.Attributes().PutStr("http.route", "/users")
+
+	name, _ := namer.GetTransactionMetricName(span, pcommon.NewInstrumentationScope())
+	assert.Equal(t, "WebTransaction/http.route/users", name)
+}
+
+func TestOtherTransactionRules(t *testing.T) {
+	namer, err := NewTransactionNamer(nil, []OtherTransactionRuleConfig{
+		{Category: "Scheduler", ScopeName: `^io\.opentelemetry\.quartz`},
+		{Category: "Task", Attribute: "job.name"},
+		{SpanKinds: []string{"internal"}},
+	})
+	assert.NoError(t, err)
+
+	span := ptrace.NewSpan()
+	span.SetName("nightly-report")
+	span.SetKind(ptrace.SpanKindInternal)
+	scope := pcommon.NewInstrumentationScope()
+
+	name, txType := namer.GetTransactionMetricName(span, scope)
+	assert.Equal(t, "OtherTransaction/Job/nightly-report", name)
+	assert.Equal(t, OtherTransactionType, txType)
+
+	span.Attributes().PutStr("job.name", "report")
+	name, _ = namer.GetTransactionMetricName(span, scope)
+	assert.Equal(t, "OtherTransaction/Task/nightly-report", name)
+
+	scope.SetName("io.opentelemetry.quartz-2.0")
+	name, _ = namer.GetTransactionMetricName(span, scope)
+	assert.Equal(t, "OtherTransaction/Scheduler/nightly-report", name)
+
+	// only root spans start a background transaction
+	span.SetParentSpanID([8]byte{1})
+	_, txType = namer.GetTransactionMetricName(span, scope)
+	assert.Equal(t, NullTransactionType, txType)
+}
+
+func TestOtherTransactionRuleSpanKind(t *testing.T) {
+	namer, _ := NewTransactionNamer(nil, []OtherTransactionRuleConfig{{SpanKinds: []string{"internal"}}})
+	span := ptrace.NewSpan()
+	span.SetKind(ptrace.SpanKindProducer)
+
+	_, txType := namer.GetTransactionMetricName(span, pcommon.NewInstrumentationScope())
+	assert.Equal(t, NullTransactionType, txType)
+}
+
+func TestOtherTransactionRuleInvalid(t *testing.T) {
+	_, err := NewTransactionNamer(nil, []OtherTransactionRuleConfig{{Category: "Job"}})
+	assert.Error(t, err)
+	_, err = NewTransactionNamer(nil, []OtherTransactionRuleConfig{{SpanKinds: []string{"sideways"}}})
+	assert.Error(t, err)
+	_, err = NewTransactionNamer(nil, []OtherTransactionRuleConfig{{ScopeName: "("}})
+	assert.Error(t, err)
+}
+
+func TestOtherTransactionBreakdown(t *testing.T) {
+	namer, _ := NewTransactionNamer(nil, []OtherTransactionRuleConfig{{SpanKinds: []string{"internal"}}})
+	transactions := NewTransactionsMap(0.5, namer, nil, nil)
+	metrics := NewMeterProvider(MetricsConfig{}).getOrCreateResourceMetrics(pcommon.NewMap())
+
+	root := newTimedTestSpan([8]byte{1}, [8]byte{}, ptrace.SpanKindInternal, 0, 100)
+	root.SetName("cleanup")
+	db := newTimedTestSpan([8]byte{2}, [8]byte{1}, ptrace.SpanKindClient, 10, 40)
+	db.Attributes().PutStr(DbSystemAttributeName, "postgresql")
+	db.Attributes().PutStr(DbOperationAttributeName, "DELETE")
+
+	for _, span := range []ptrace.Span{root, db} {
+		transactions.IndexSpan(span, metrics)
+	}
+	for _, span := range []ptrace.Span{root, db} {
+		transaction, _ := transactions.GetOrCreateTransaction("python", span, metrics)
+		transaction.AddSpan(span, pcommon.NewInstrumentationScope())
+	}
+	transactions.ProcessTransactions()
+
+	duration := metrics.nameToMetric["apm.service.transaction.duration"].Histogram().DataPoints()
+	assert.Equal(t, 1, duration.Len())
+	name, _ := duration.At(0).Attributes().Get("transactionName")
+	assert.Equal(t, "OtherTransaction/Job/cleanup", name.AsString())
+
+	breakdown := make(map[string]float64)
+	overview := metrics.nameToMetric["apm.service.overview.other"].Histogram().DataPoints()
+	for i := 0; i < overview.Len(); i++ {
+		segment, _ := overview.At(i).Attributes().Get("segmentName")
+		breakdown[segment.AsString()] += overview.At(i).Sum()
+	}
+	assert.Equal(t, map[string]float64{"python": 70e-9, "postgresql": 30e-9}, breakdown)
+	_, apdexPresent := metrics.nameToMetric["apm.service.apdex"]
+	assert.False(t, apdexPresent)
+}
+
+func TestNoOtherTransactionRulesByDefault(t *testing.T) {
+	config := createDefaultConfig().(*Config)
+	namer, err := NewTransactionNamer(config.NamingRules, config.OtherTransactionRules)
+	assert.NoError(t, err)
+
+	span := ptrace.NewSpan()
+	span.SetName("nightly-report")
+	span.SetKind(ptrace.SpanKindInternal)
+	_, txType := namer.GetTransactionMetricName(span, pcommon.NewInstrumentationScope())
+	assert.Equal(t, NullTransactionType, txType)
+}
@@ -48,9 +48,9 @@ func TestGetTransactionMetricNamUrlPath(t *testing.T) {
 }
 
 func TestGetOrCreateTransaction(t *testing.T) {
-	transactions := NewTransactionsMap(0.5)
+	transactions := NewTransactionsMap(0.5, &TransactionNamer{}, nil, nil)
 	span := ptrace.NewSpan()
-	meterProvider := NewMeterProvider()
+	meterProvider := NewMeterProvider(MetricsConfig{})
 	metrics := meterProvider.getOrCreateResourceMetrics(pcommon.NewMap())
 	transaction, _ := transactions.GetOrCreateTransaction("java", span, metrics)
 
@@ -62,3 +62,268 @@ func TestGetOrCreateTransaction(t *testing.T) {
 	assert.Equal(t, transaction, existingTransaction)
 	assert.Equal(t, true, existingTransaction.IsRootSet())
 }
+
+func TestGetOrCreateTransactionPerService(t *testing.T) {
+	transactions := NewTransactionsMap(0.5, &TransactionNamer{}, nil, nil)
+	meterProvider := NewMeterProvider(MetricsConfig{})
+	frontendAttributes := pcommon.NewMap()
+	frontendAttributes.PutStr("service.name", "frontend")
+	frontend := meterProvider.getOrCreateResourceMetrics(frontendAttributes)
+	backendAttributes := pcommon.NewMap()
+	backendAttributes.PutStr("service.name", "backend")
+	backend := meterProvider.getOrCreateResourceMetrics(backendAttributes)
+
+	frontendServer := newTestSpan([8]byte{1}, [8]byte{}, ptrace.SpanKindServer)
+	frontendClient := newTestSpan([8]byte{2}, [8]byte{1}, ptrace.SpanKindClient)
+	backendServer := newTestSpan([8]byte{3}, [8]byte{2}, ptrace.SpanKindServer)
+	backendInternal := newTestSpan([8]byte{4}, [8]byte{3}, ptrace.SpanKindInternal)
+	backendDb := newTestSpan([8]byte{5}, [8]byte{4}, ptrace.SpanKindClient)
+
+	for _, span := range []ptrace.Span{frontendServer, frontendClient} {
+		transactions.IndexSpan(span, frontend)
+	}
+	for _, span := range []ptrace.Span{backendServer, backendInternal, backendDb} {
+		transactions.IndexSpan(span, backend)
+	}
+
+	frontendTransaction, _ := transactions.GetOrCreateTransaction("java", frontendClient, frontend)
+	backendTransaction, _ := transactions.GetOrCreateTransaction("go", backendDb, backend)
+	assert.NotSame(t, frontendTransaction, backendTransaction)
+	assert.Equal(t, frontend, frontendTransaction.resourceMetrics)
+	assert.Equal(t, backend, backendTransaction.resourceMetrics)
+
+	// the child is processed before its entry span, it still ends up in the same transaction
+	transaction, _ := transactions.GetOrCreateTransaction("go", backendServer, backend)
+	assert.Same(t, backendTransaction, transaction)
+	transaction, _ = transactions.GetOrCreateTransaction("java", frontendServer, frontend)
+	assert.Same(t, frontendTransaction, transaction)
+	assert.Equal(t, 2, len(transactions.Transactions))
+}
+
+func TestGetOrCreateTransactionSeveralEntrySpans(t *testing.T) {
+	transactions := NewTransactionsMap(0.5, &TransactionNamer{}, nil, nil)
+	metrics := NewMeterProvider(MetricsConfig{}).getOrCreateResourceMetrics(pcommon.NewMap())
+
+	// the same service is called twice in the trace, from a service we have not seen
+	first := newTestSpan([8]byte{1}, [8]byte{9}, ptrace.SpanKindServer)
+	second := newTestSpan([8]byte{2}, [8]byte{9}, ptrace.SpanKindServer)
+	transactions.IndexSpan(first, metrics)
+	transactions.IndexSpan(second, metrics)
+
+	firstTransaction, _ := transactions.GetOrCreateTransaction("java", first, metrics)
+	secondTransaction, _ := transactions.GetOrCreateTransaction("java", second, metrics)
+	assert.NotSame(t, firstTransaction, secondTransaction)
+}
+
+func newTestSpan(spanID, parentSpanID pcommon.SpanID, kind ptrace.SpanKind) ptrace.Span {
+	span := ptrace.NewSpan()
+	span.SetTraceID([16]byte{1})
+	span.SetSpanID(spanID)
+	span.SetParentSpanID(parentSpanID)
+	span.SetKind(kind)
+	return span
+}
+
+func TestExclusiveDurationNoChildren(t *testing.T) {
+	assert.Equal(t, int64(100), ExclusiveDuration(TimeInterval{Start: 0, End: 100}, nil))
+}
+
+func TestExclusiveDurationSequentialChildren(t *testing.T) {
+	children := []TimeInterval{{Start: 10, End: 20}, {Start: 30, End: 50}}
+	assert.Equal(t, int64(70), ExclusiveDuration(TimeInterval{Start: 0, End: 100}, children))
+}
+
+func TestExclusiveDurationOverlappingChildren(t *testing.T) {
+	children := []TimeInterval{{Start: 10, End: 60}, {Start: 20, End: 70}, {Start: 30, End: 40}}
+	assert.Equal(t, int64(40), ExclusiveDuration(TimeInterval{Start: 0, End: 100}, children))
+}
+
+func TestExclusiveDurationOutOfOrderChildren(t *testing.T) {
+	children := []TimeInterval{{Start: 80, End: 90}, {Start: 10, End: 30}, {Start: 25, End: 50}}
+	assert.Equal(t, int64(50), ExclusiveDuration(TimeInterval{Start: 0, End: 100}, children))
+}
+
+func TestExclusiveDurationClockSkew(t *testing.T) {
+	children := []TimeInterval{{Start: -20, End: 30}, {Start: 90, End: 150}, {Start: 200, End: 300}}
+	assert.Equal(t, int64(60), ExclusiveDuration(TimeInterval{Start: 0, End: 100}, children))
+}
+
+func TestExclusiveDurationChildrenCoverParent(t *testing.T) {
+	children := []TimeInterval{{Start: 0, End: 100}, {Start: 0, End: 100}}
+	assert.Equal(t, int64(0), ExclusiveDuration(TimeInterval{Start: 0, End: 100}, children))
+}
+
+func TestTransactionConcurrentChildren(t *testing.T) {
+	transactions := NewTransactionsMap(0.5, &TransactionNamer{}, nil, nil)
+	meterProvider := NewMeterProvider(MetricsConfig{})
+	metrics := meterProvider.getOrCreateResourceMetrics(pcommon.NewMap())
+
+	root := newTimedTestSpan([8]byte{1}, [8]byte{}, ptrace.SpanKindServer, 0, 100)
+	handler := newTimedTestSpan([8]byte{2}, [8]byte{1}, ptrace.SpanKindInternal, 10, 90)
+	// two database calls in parallel, reported before their parent
+	db1 := newTimedTestSpan([8]byte{3}, [8]byte{2}, ptrace.SpanKindClient, 20, 70)
+	db2 := newTimedTestSpan([8]byte{4}, [8]byte{2}, ptrace.SpanKindClient, 30, 80)
+	for _, span := range []ptrace.Span{db1, db2} {
+		span.Attributes().PutStr(DbSystemAttributeName, "postgresql")
+		span.Attributes().PutStr(DbOperationAttributeName, "SELECT")
+	}
+
+	spans := []ptrace.Span{db2, db1, handler, root}
+	for _, span := range spans {
+		transactions.IndexSpan(span, metrics)
+	}
+	for _, span := range spans {
+		transaction, _ := transactions.GetOrCreateTransaction("go", span, metrics)
+		transaction.AddSpan(span, pcommon.NewInstrumentationScope())
+	}
+	assert.Equal(t, 1, len(transactions.Transactions))
+	transactions.ProcessTransactions()
+
+	for _, transaction := range transactions.Transactions {
+		assert.Equal(t, int64(20), transaction.Measurements[handler.SpanID().String()].ExclusiveDurationNanos)
+		assert.Equal(t, int64(50), transaction.Measurements[db1.SpanID().String()].ExclusiveDurationNanos)
+		assert.Equal(t, int64(50), transaction.Measurements[db2.SpanID().String()].ExclusiveDurationNanos)
+	}
+
+	breakdown := make(map[string]float64)
+	dps := metrics.nameToMetric["apm.service.overview.web"].Histogram().DataPoints()
+	for i := 0; i < dps.Len(); i++ {
+		segment, _ := dps.At(i).Attributes().Get("segmentName")
+		breakdown[segment.AsString()] += dps.At(i).Sum()
+		assert.True(t, dps.At(i).Sum() >= 0)
+	}
+	assert.Equal(t, map[string]float64{"go": 40e-9, "postgresql": 100e-9}, breakdown)
+}
+
+func newTimedTestSpan(spanID, parentSpanID pcommon.SpanID, kind ptrace.SpanKind, start, end int64) ptrace.Span {
+	span := newTestSpan(spanID, parentSpanID, kind)
+	span.SetStartTimestamp(pcommon.Timestamp(start))
+	span.SetEndTimestamp(pcommon.Timestamp(end))
+	return span
+}
+
+func TestRollupMetrics(t *testing.T) {
+	namer, _ := NewTransactionNamer(nil, []OtherTransactionRuleConfig{{SpanKinds: []string{"internal"}}})
+	transactions := NewTransactionsMap(0.5, namer, nil, nil)
+	metrics := NewMeterProvider(MetricsConfig{}).getOrCreateResourceMetrics(pcommon.NewMap())
+
+	newDbSpan := func(spanID, parentID byte, dbSystem, operation string) ptrace.Span {
+		span := newTimedTestSpan([8]byte{spanID}, [8]byte{parentID}, ptrace.SpanKindClient, 10, 20)
+		span.Attributes().PutStr(DbSystemAttributeName, dbSystem)
+		span.Attributes().PutStr(DbOperationAttributeName, operation)
+		return span
+	}
+	newExternalSpan := func(spanID, parentID byte, host string) ptrace.Span {
+		span := newTimedTestSpan([8]byte{spanID}, [8]byte{parentID}, ptrace.SpanKindClient, 30, 40)
+		span.Attributes().PutStr("server.address", host)
+		return span
+	}
+
+	web := newTimedTestSpan([8]byte{1}, [8]byte{}, ptrace.SpanKindServer, 0, 100)
+	rpc := newExternalSpan(6, 1, "inventory")
+	rpc.Attributes().PutStr(RpcSystemAttributeName, "grpc")
+	job := newTimedTestSpan([8]byte{10}, [8]byte{}, ptrace.SpanKindInternal, 0, 100)
+	job.SetTraceID([16]byte{2})
+	jobDb := newDbSpan(11, 10, "postgresql", "DELETE")
+	jobDb.SetTraceID([16]byte{2})
+	jobDb.Attributes().PutStr(DbSqlTableAttributeName, "sessions")
+	// calls without a table are named Datastore/operation/..., they are not rolled up again
+	withTable := newDbSpan(2, 1, "postgresql", "SELECT")
+	withTable.Attributes().PutStr(DbSqlTableAttributeName, "users")
+
+	spans := []ptrace.Span{web, withTable, newDbSpan(3, 1, "postgresql", "SELECT"),
+		newDbSpan(4, 1, "redis", "GET"), newExternalSpan(5, 1, "api.example.com"), rpc, job, jobDb}
+	for _, span := range spans {
+		transactions.IndexSpan(span, metrics)
+	}
+	for _, span := range spans {
+		transaction, _ := transactions.GetOrCreateTransaction("java", span, metrics)
+		transaction.AddSpan(span, pcommon.NewInstrumentationScope())
+	}
+	transactions.ProcessTransactions()
+
+	counts := make(map[string]uint64)
+	for _, metricName := range []string{"apm.service.datastore.rollup.duration", "apm.service.external.rollup.duration"} {
+		dataPoints := metrics.nameToMetric[metricName].Histogram().DataPoints()
+		for i := 0; i < dataPoints.Len(); i++ {
+			name, _ := dataPoints.At(i).Attributes().Get("metricTimesliceName")
+			counts[name.AsString()] += dataPoints.At(i).Count()
+		}
+	}
+	assert.Equal(t, map[string]uint64{
+		"Datastore/all":                         4,
+		"Datastore/allWeb":                      3,
+		"Datastore/allOther":                    1,
+		"Datastore/postgresql/all":              3,
+		"Datastore/redis/all":                   1,
+		"Datastore/operation/postgresql/SELECT": 1,
+		"Datastore/operation/postgresql/DELETE": 1,
+		"External/all":                          2,
+		"External/allWeb":                       2,
+		"External/api.example.com/all":          1,
+		"External/inventory/all":                1,
+	}, counts)
+}
+
+func TestExternalSpan(t *testing.T) {
+	transactions := NewTransactionsMap(0.5, &TransactionNamer{}, nil, nil)
+	metrics := NewMeterProvider(MetricsConfig{}).getOrCreateResourceMetrics(pcommon.NewMap())
+	scope := pcommon.NewInstrumentationScope()
+	scope.SetName("io.opentelemetry.okhttp-3.0")
+
+	root := newTimedTestSpan([8]byte{1}, [8]byte{}, ptrace.SpanKindServer, 0, 100)
+	fromUrl := newTimedTestSpan([8]byte{2}, [8]byte{1}, ptrace.SpanKindClient, 10, 20)
+	fromUrl.Attributes().PutStr("url.full", "https://api.example.com:8443/v1/orders?id=1")
+	fromUrl.Attributes().PutStr("http.request.method", "POST")
+	fromUrl.Attributes().PutInt("http.response.status_code", 503)
+	fromPeer := newTimedTestSpan([8]byte{3}, [8]byte{1}, ptrace.SpanKindClient, 20, 30)
+	fromPeer.Attributes().PutStr("peer.service", "billing")
+	fromPeer.Status().SetCode(ptrace.StatusCodeError)
+	succeeded := newTimedTestSpan([8]byte{4}, [8]byte{1}, ptrace.SpanKindClient, 30, 40)
+	succeeded.Attributes().PutStr("server.address", "api.example.com")
+	succeeded.Attributes().PutStr("http.method", "GET")
+	succeeded.Attributes().PutStr("http.status_code", "200")
+
+	spans := []ptrace.Span{root, fromUrl, fromPeer, succeeded}
+	for _, span := range spans {
+		transactions.IndexSpan(span, metrics)
+	}
+	for _, span := range spans {
+		transaction, _ := transactions.GetOrCreateTransaction("java", span, metrics)
+		transaction.AddSpan(span, scope)
+	}
+	transactions.ProcessTransactions()
+
+	for _, transaction := range transactions.Transactions {
+		measurement := transaction.Measurements[fromUrl.SpanID().String()]
+		assert.Equal(t, "External/api.example.com/okhttp/POST", measurement.MetricTimesliceName)
+		statusClass, _ := measurement.Attributes.Get("http.statusClass")
+		assert.Equal(t, "5xx", statusClass.AsString())
+
+		measurement = transaction.Measurements[fromPeer.SpanID().String()]
+		assert.Equal(t, "External/billing/okhttp", measurement.MetricTimesliceName)
+		peerService, _ := measurement.Attributes.Get("peer.service")
+		assert.Equal(t, "billing", peerService.AsString())
+	}
+
+	errors := make(map[string]int64)
+	dataPoints := metrics.nameToMetric["apm.service.external.error.count"].Sum().DataPoints()
+	for i := 0; i < dataPoints.Len(); i++ {
+		host, _ := dataPoints.At(i).Attributes().Get("external.host")
+		errors[host.AsString()] += dataPoints.At(i).IntValue()
+	}
+	assert.Equal(t, map[string]int64{"api.example.com": 1, "billing": 1}, errors)
+	_, transactionError := metrics.nameToMetric["apm.service.error.count"]
+	assert.False(t, transactionError)
+}
+
+func TestGetExternalLibrary(t *testing.T) {
+	scope := pcommon.NewInstrumentationScope()
+	assert.Equal(t, "http", GetExternalLibrary(scope))
+	scope.SetName("go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp")
+	assert.Equal(t, "otelhttp", GetExternalLibrary(scope))
+	scope.SetName("io.opentelemetry.java-http-client")
+	assert.Equal(t, "java-http-client", GetExternalLibrary(scope))
+	scope.SetName("opentelemetry.instrumentation.requests")
+	assert.Equal(t, "requests", GetExternalLibrary(scope))
+}
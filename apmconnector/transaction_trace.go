@@ -0,0 +1,168 @@
+package apmconnector
+
+import (
+	"sort"
+	"sync"
+
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/plog"
+)
+
+type sampledTransactionTrace struct {
+	durationNanos int64
+	logs          plog.Logs
+}
+
+// TransactionTraceSampler keeps, for each transaction name of each service, the slowest
+// transaction over the threshold until the traces are harvested. At most maxTraces are kept,
+// the slowest ones.
+type TransactionTraceSampler struct {
+	mu             sync.Mutex
+	thresholdNanos int64
+	maxTraces      int
+	slowestByName  map[string]*sampledTransactionTrace
+}
+
+// NewTransactionTraceSampler creates a sampler of the transactions slower than threshold seconds
+func NewTransactionTraceSampler(threshold float64, maxTraces int) *TransactionTraceSampler {
+	return &TransactionTraceSampler{thresholdNanos: int64(threshold * 1e9), maxTraces: maxTraces,
+		slowestByName: make(map[string]*sampledTransactionTrace)}
+}
+
+// Offer keeps the trace of a transaction when it is the slowest of its name since the last harvest.
+// Nothing is kept without a sampler.
+func (sampler *TransactionTraceSampler) Offer(transaction *Transaction, transactionName string, transactionType TransactionType,
+	resource pcommon.Resource) {
+	if sampler == nil || !transaction.IsRootSet() {
+		return
+	}
+	durationNanos := DurationInNanos(transaction.RootSpan)
+	if durationNanos < sampler.thresholdNanos {
+		return
+	}
+	// the instances of a service share their slowest transactions
+	key := transaction.resourceMetrics.serviceName + "/" + transactionName
+
+	sampler.mu.Lock()
+	defer sampler.mu.Unlock()
+	slowest, exists := sampler.slowestByName[key]
+	if exists && slowest.durationNanos >= durationNanos {
+		return
+	}
+	if !exists && len(sampler.slowestByName) >= sampler.maxTraces {
+		// make room by dropping the fastest trace, unless this one is faster
+		fastestKey := ""
+		for sampledKey, sampled := range sampler.slowestByName {
+			if fastestKey == "" || sampled.durationNanos < sampler.slowestByName[fastestKey].durationNanos {
+				fastestKey = sampledKey
+			}
+		}
+		if fastestKey == "" || sampler.slowestByName[fastestKey].durationNanos >= durationNanos {
+			return
+		}
+		delete(sampler.slowestByName, fastestKey)
+	}
+	logs := plog.NewLogs()
+	resourceLogs := logs.ResourceLogs().AppendEmpty()
+	resource.CopyTo(resourceLogs.Resource())
+	buildTransactionTrace(resourceLogs.ScopeLogs().AppendEmpty().LogRecords().AppendEmpty(), transaction, transactionName, transactionType)
+	sampler.slowestByName[key] = &sampledTransactionTrace{durationNanos: durationNanos, logs: logs}
+}
+
+// Harvest returns the traces kept since the last harvest
+func (sampler *TransactionTraceSampler) Harvest() plog.Logs {
+	logs := plog.NewLogs()
+	if sampler == nil {
+		return logs
+	}
+	sampler.mu.Lock()
+	defer sampler.mu.Unlock()
+	for _, sampled := range sampler.slowestByName {
+		sampled.logs.ResourceLogs().MoveAndAppendTo(logs.ResourceLogs())
+	}
+	sampler.slowestByName = make(map[string]*sampledTransactionTrace)
+	return logs
+}
+
+// buildTransactionTrace describes a transaction with the tree of its segments, the root segment is
+// the entry span and the others are the measurements of the transaction
+func buildTransactionTrace(lr plog.LogRecord, transaction *Transaction, transactionName string, transactionType TransactionType) {
+	span := transaction.RootSpan
+	lr.SetTimestamp(span.StartTimestamp())
+	lr.Attributes().PutStr("event.domain", "newrelic.otel_collector")
+	lr.Attributes().PutStr("event.name", "TransactionTrace")
+
+	lr.Attributes().PutStr("transactionName", transactionName)
+	lr.Attributes().PutStr("transactionType", transactionType.AsString())
+	lr.Attributes().PutStr("trace.id", span.TraceID().String())
+	lr.Attributes().PutDouble("duration", NanosToSeconds(DurationInNanos(span)))
+	if transaction.resourceMetrics.hostName != "" {
+		lr.Attributes().PutStr("host", transaction.resourceMetrics.hostName)
+	}
+
+	// the measurements whose parent is not measured hang from the root segment
+	rootSpanId := span.SpanID().String()
+	children := make(map[string][]*Measurement)
+	for spanId, measurement := range transaction.Measurements {
+		if spanId == rootSpanId {
+			continue
+		}
+		parentSpanId := measurement.Span.ParentSpanID().String()
+		if _, parentMeasured := transaction.Measurements[parentSpanId]; !parentMeasured {
+			parentSpanId = rootSpanId
+		}
+		children[parentSpanId] = append(children[parentSpanId], measurement)
+	}
+
+	root := lr.Attributes().PutEmptyMap("segments")
+	root.PutStr("name", transactionName)
+	root.PutDouble("startOffset", 0)
+	root.PutDouble("duration", NanosToSeconds(DurationInNanos(span)))
+	root.PutDouble("exclusiveDuration", NanosToSeconds(ExclusiveDuration(NewTimeInterval(span), transaction.SpanToChildren[rootSpanId])))
+	rootAttributes := root.PutEmptyMap("attributes")
+	if measurement, measured := transaction.Measurements[rootSpanId]; measured {
+		measurement.Attributes.CopyTo(rootAttributes)
+	}
+	addTraceSegments(root, transaction, children, rootSpanId, span.StartTimestamp())
+}
+
+// addTraceSegments adds the children of a segment, in the order they started
+func addTraceSegments(segment pcommon.Map, transaction *Transaction, children map[string][]*Measurement, spanId string,
+	traceStart pcommon.Timestamp) {
+	measurements := children[spanId]
+	sort.Slice(measurements, func(i, j int) bool {
+		return measurements[i].Span.StartTimestamp() < measurements[j].Span.StartTimestamp()
+	})
+	segments := segment.PutEmptySlice("children")
+	for _, measurement := range measurements {
+		child := segments.AppendEmpty().SetEmptyMap()
+		child.PutStr("name", measurement.MetricTimesliceName)
+		child.PutDouble("startOffset", NanosToSeconds(int64(measurement.Span.StartTimestamp())-int64(traceStart)))
+		child.PutDouble("duration", NanosToSeconds(measurement.DurationNanos))
+		child.PutDouble("exclusiveDuration", NanosToSeconds(measurement.ExclusiveTime(transaction)))
+		attributes := child.PutEmptyMap("attributes")
+		measurement.Attributes.CopyTo(attributes)
+		addTraceSegmentStatement(attributes, measurement)
+		addTraceSegments(child, transaction, children, measurement.SpanId, traceStart)
+	}
+}
+
+// addTraceSegmentStatement adds the obfuscated statement of a database call, except for the non SQL
+// systems whose statements cannot be obfuscated
+func addTraceSegmentStatement(attributes pcommon.Map, measurement *Measurement) {
+	if measurement.Category != DatastoreSpanCategory {
+		return
+	}
+	statement, exists := DbQueryTextAttribute.Get(measurement.Span.Attributes())
+	if !exists {
+		return
+	}
+	dbSystem := ""
+	if value, exists := attributes.Get(DbSystemAttributeName); exists {
+		dbSystem = value.AsString()
+	}
+	if nonSqlDbSystems[dbSystem] {
+		return
+	}
+	attributes.PutStr("db.statement", ObfuscateSql(statement.AsString(), dbSystem))
+}
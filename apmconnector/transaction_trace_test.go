@@ -0,0 +1,130 @@
+package apmconnector
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/collector/component/componenttest"
+	"go.opentelemetry.io/collector/connector/connectortest"
+	"go.opentelemetry.io/collector/consumer/consumertest"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+	"testing"
+	"time"
+)
+
+func newTraceTestTraces(traceID byte, durationNanos int64) ptrace.Traces {
+	traces := ptrace.NewTraces()
+	resourceSpans := traces.ResourceSpans().AppendEmpty()
+	resourceSpans.Resource().Attributes().PutStr("service.name", "orders")
+	spans := resourceSpans.ScopeSpans().AppendEmpty().Spans()
+	root := newTimedTestSpan([8]byte{1}, [8]byte{}, ptrace.SpanKindServer, 0, durationNanos)
+	root.SetTraceID([16]byte{traceID})
+	root.Attributes().PutStr("http.route", "/orders")
+	root.CopyTo(spans.AppendEmpty())
+
+	external := newTimedTestSpan([8]byte{2}, [8]byte{1}, ptrace.SpanKindClient, 100, 600)
+	external.SetTraceID([16]byte{traceID})
+	external.Attributes().PutStr("server.address", "billing")
+	external.CopyTo(spans.AppendEmpty())
+	query := newTimedTestSpan([8]byte{3}, [8]byte{2}, ptrace.SpanKindClient, 200, 300)
+	query.SetTraceID([16]byte{traceID})
+	query.Attributes().PutStr("db.system", "mysql")
+	query.Attributes().PutStr("db.statement", "SELECT * FROM orders WHERE id = 12")
+	query.CopyTo(spans.AppendEmpty())
+	first := newTimedTestSpan([8]byte{4}, [8]byte{1}, ptrace.SpanKindInternal, 50, 80)
+	first.SetTraceID([16]byte{traceID})
+	first.SetName("validate")
+	first.CopyTo(spans.AppendEmpty())
+	return traces
+}
+
+func TestSampleSlowestTransactionTrace(t *testing.T) {
+	sampler := NewTransactionTraceSampler(800e-9, 10)
+	for traceID, duration := range map[byte]int64{1: 700, 2: 2000, 3: 1000} {
+		logs := BuildTransactions(&TransactionNamer{}, nil, 0.5, LogsOutputTransactions, sampler, newTraceTestTraces(traceID, duration))
+		assert.Equal(t, 0, len(getLogRecords(logs, "TransactionTrace")))
+	}
+
+	records := getLogRecords(sampler.Harvest(), "TransactionTrace")
+	assert.Equal(t, 1, len(records))
+	attributes := records[0].Attributes().AsRaw()
+	assert.Equal(t, "WebTransaction/http.route/orders", attributes["transactionName"])
+	assert.Equal(t, pcommon.TraceID([16]byte{2}).String(), attributes["trace.id"])
+	assert.Equal(t, 2000e-9, attributes["duration"])
+
+	root := attributes["segments"].(map[string]any)
+	assert.Equal(t, "WebTransaction/http.route/orders", root["name"])
+	assert.Equal(t, 1470e-9, root["exclusiveDuration"])
+	children := root["children"].([]any)
+	assert.Equal(t, 2, len(children))
+	assert.Equal(t, "Custom/validate", children[0].(map[string]any)["name"])
+
+	external := children[1].(map[string]any)
+	assert.Equal(t, "External/billing/http", external["name"])
+	assert.Equal(t, 100e-9, external["startOffset"])
+	assert.Equal(t, 500e-9, external["duration"])
+	assert.Equal(t, 400e-9, external["exclusiveDuration"])
+	query := external["children"].([]any)[0].(map[string]any)
+	assert.Equal(t, "Datastore/statement/mysql/orders/SELECT", query["name"])
+	assert.Equal(t, 200e-9, query["startOffset"])
+	statement := query["attributes"].(map[string]any)["db.statement"]
+	assert.Equal(t, "SELECT * FROM orders WHERE id = ?", statement)
+
+	assert.Equal(t, 0, sampler.Harvest().LogRecordCount())
+}
+
+func TestSampleSlowestTransactionTraceOfService(t *testing.T) {
+	sampler := NewTransactionTraceSampler(800e-9, 10)
+	for i, duration := range []int64{1000, 3000, 2000} {
+		traces := newTraceTestTraces(byte(i+1), duration)
+		traces.ResourceSpans().At(0).Resource().Attributes().PutStr("host.name", "web-"+string(rune('a'+i)))
+		BuildTransactions(&TransactionNamer{}, nil, 0.5, LogsOutputTransactions, sampler, traces)
+	}
+
+	records := getLogRecords(sampler.Harvest(), "TransactionTrace")
+	assert.Equal(t, 1, len(records))
+	duration, _ := records[0].Attributes().Get("duration")
+	assert.Equal(t, 3000e-9, duration.Double())
+}
+
+func TestNoTransactionTraceWithoutSampler(t *testing.T) {
+	var sampler *TransactionTraceSampler
+	BuildTransactions(&TransactionNamer{}, nil, 0.5, LogsOutputTransactions, sampler, newTraceTestTraces(1, 2000))
+	assert.Equal(t, 0, sampler.Harvest().LogRecordCount())
+}
+
+func TestCapTransactionTraces(t *testing.T) {
+	sampler := NewTransactionTraceSampler(800e-9, 2)
+	for i, duration := range []int64{1000, 3000, 2000, 900} {
+		traces := newTraceTestTraces(byte(i+1), duration)
+		root := traces.ResourceSpans().At(0).ScopeSpans().At(0).Spans().At(0)
+		root.Attributes().PutStr("http.route", "/orders/"+string(rune('a'+i)))
+		BuildTransactions(&TransactionNamer{}, nil, 0.5, LogsOutputTransactions, sampler, traces)
+	}
+
+	durations := make(map[float64]bool)
+	for _, record := range getLogRecords(sampler.Harvest(), "TransactionTrace") {
+		duration, _ := record.Attributes().Get("duration")
+		durations[duration.Double()] = true
+	}
+	assert.Equal(t, map[float64]bool{3000e-9: true, 2000e-9: true}, durations)
+}
+
+func TestTransactionTracesHarvestedOnShutdown(t *testing.T) {
+	sink := &consumertest.LogsSink{}
+	config := createDefaultConfig().(*Config)
+	config.TransactionTraces.Threshold = time.Microsecond
+	connector, err := createTracesToLogs(context.Background(), connectortest.NewNopCreateSettings(), config, sink)
+	assert.NoError(t, err)
+	assert.NoError(t, connector.Start(context.Background(), componenttest.NewNopHost()))
+	assert.NoError(t, connector.ConsumeTraces(context.Background(), newTraceTestTraces(1, 2000)))
+
+	assert.NoError(t, connector.Shutdown(context.Background()))
+	// shutting down again is a no-op
+	assert.NoError(t, connector.Shutdown(context.Background()))
+	traceCount := 0
+	for _, logs := range sink.AllLogs() {
+		traceCount += len(getLogRecords(logs, "TransactionTrace"))
+	}
+	assert.Equal(t, 1, traceCount)
+}